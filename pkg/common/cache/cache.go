@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Config describes where responses are cached and for how long they may
+// still change. Caching is disabled when Dir is empty.
+type Config struct {
+	// Dir is the directory responses are cached in. It should be on a volume
+	// that survives pod restarts.
+	Dir string
+	// RestatementHorizon is how long after a window ends the cost source may
+	// still restate its costs, e.g. "72h". Windows that ended more recently
+	// than that are always refetched.
+	RestatementHorizon string
+}
+
+// Plugins whose costs can still change after the restatement horizon, e.g.
+// because they're priced with rates that are only estimates until the vendor
+// closes the billing period, set StatusMetadataKey in the response metadata.
+// Responses with StatusEstimated are never cached.
+const (
+	StatusMetadataKey = "cost_status"
+	StatusEstimated   = "estimated"
+	StatusFinal       = "final"
+)
+
+// Cache stores the responses for finalized windows on disk, so that they
+// don't have to be fetched again after the plugin restarts.
+type Cache struct {
+	dir     string
+	horizon time.Duration
+}
+
+// New returns the cache described by config, or nil if caching is disabled.
+// defaultHorizon is used if config doesn't set a restatement horizon.
+func New(config Config, defaultHorizon time.Duration) (*Cache, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+
+	horizon := defaultHorizon
+	if config.RestatementHorizon != "" {
+		var err error
+		horizon, err = time.ParseDuration(config.RestatementHorizon)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cache restatement horizon %q: %v", config.RestatementHorizon, err)
+		}
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache dir %s: %v", config.Dir, err)
+	}
+
+	return &Cache{
+		dir:     config.Dir,
+		horizon: horizon,
+	}, nil
+}
+
+// IsFinal reports whether the costs for window can no longer change.
+func (c *Cache) IsFinal(window opencost.Window) bool {
+	return window.End().Before(time.Now().UTC().Add(-c.horizon))
+}
+
+// Get returns the cached response for the window, if there is one and the
+// window is final.
+func (c *Cache) Get(plugin string, window opencost.Window, resolution time.Duration) (*pb.CustomCostResponse, bool) {
+	if !c.IsFinal(window) {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(c.path(plugin, window, resolution))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("error reading cached response for window %v: %v", window, err)
+		}
+		return nil, false
+	}
+
+	resp := &pb.CustomCostResponse{}
+	if err := protojson.Unmarshal(data, resp); err != nil {
+		log.Warnf("error unmarshalling cached response for window %v: %v", window, err)
+		return nil, false
+	}
+
+	return resp, true
+}
+
+// Put caches the response for the window. Responses for windows that aren't
+// final yet, responses with errors, and responses with estimated costs are not
+// cached.
+func (c *Cache) Put(plugin string, window opencost.Window, resolution time.Duration, resp *pb.CustomCostResponse) error {
+	if !c.IsFinal(window) || len(resp.Errors) > 0 || resp.Metadata[StatusMetadataKey] == StatusEstimated {
+		return nil
+	}
+
+	data, err := protojson.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("error marshalling response: %v", err)
+	}
+
+	path := c.path(plugin, window, resolution)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating cache dir: %v", err)
+	}
+
+	// write to a temp file first so a crash never leaves a partial response behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temp file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) path(plugin string, window opencost.Window, resolution time.Duration) string {
+	filename := fmt.Sprintf("%d-%d.json", window.Start().Unix(), window.End().Unix())
+	return filepath.Join(c.dir, plugin, resolution.String(), filename)
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+)
+
+func TestDisabledWithoutDir(t *testing.T) {
+	c, err := New(Config{}, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c != nil {
+		t.Fatalf("expected cache to be disabled")
+	}
+}
+
+func TestBadRestatementHorizon(t *testing.T) {
+	_, err := New(Config{Dir: t.TempDir(), RestatementHorizon: "three days"}, 72*time.Hour)
+	if err == nil {
+		t.Fatalf("expected an error, but got none")
+	}
+}
+
+func TestPutGetFinalWindow(t *testing.T) {
+	c, err := New(Config{Dir: t.TempDir(), RestatementHorizon: "72h"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	resp := &pb.CustomCostResponse{
+		Domain: "test",
+		Costs: []*pb.CustomCost{
+			{ResourceName: "widgets", BilledCost: 1.5},
+		},
+	}
+	if err := c.Put("test", window, 24*time.Hour, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cached, ok := c.Get("test", window, 24*time.Hour)
+	if !ok {
+		t.Fatalf("expected cache hit")
+	}
+	if cached.Domain != "test" || len(cached.Costs) != 1 || cached.Costs[0].BilledCost != 1.5 {
+		t.Errorf("unexpected cached response: %v", cached)
+	}
+
+	// the same window at another resolution, or for another plugin, is a different entry
+	if _, ok := c.Get("test", window, time.Hour); ok {
+		t.Errorf("expected cache miss for a different resolution")
+	}
+	if _, ok := c.Get("other", window, 24*time.Hour); ok {
+		t.Errorf("expected cache miss for a different plugin")
+	}
+}
+
+func TestRecentWindowsNotCached(t *testing.T) {
+	c, err := New(Config{Dir: t.TempDir()}, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now().UTC().Truncate(24 * time.Hour).Add(-48 * time.Hour)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	if err := c.Put("test", window, 24*time.Hour, &pb.CustomCostResponse{Domain: "test"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := c.Get("test", window, 24*time.Hour); ok {
+		t.Errorf("expected window inside restatement horizon not to be cached")
+	}
+}
+
+func TestResponsesWithErrorsNotCached(t *testing.T) {
+	c, err := New(Config{Dir: t.TempDir()}, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	resp := &pb.CustomCostResponse{Domain: "test", Errors: []string{"mock error"}}
+	if err := c.Put("test", window, 24*time.Hour, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := c.Get("test", window, 24*time.Hour); ok {
+		t.Errorf("expected response with errors not to be cached")
+	}
+}
+
+func TestEstimatedResponsesNotCached(t *testing.T) {
+	c, err := New(Config{Dir: t.TempDir()}, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	resp := &pb.CustomCostResponse{Domain: "test", Metadata: map[string]string{StatusMetadataKey: StatusEstimated}}
+	if err := c.Put("test", window, 24*time.Hour, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := c.Get("test", window, 24*time.Hour); ok {
+		t.Errorf("expected estimated response not to be cached")
+	}
+
+	resp.Metadata[StatusMetadataKey] = StatusFinal
+	if err := c.Put("test", window, 24*time.Hour, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := c.Get("test", window, 24*time.Hour); !ok {
+		t.Errorf("expected final response to be cached")
+	}
+}
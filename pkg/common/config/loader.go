@@ -0,0 +1,257 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretFilePrefix marks a config value that must be read from a file, such as
+// a Kubernetes secret mounted into the plugin's pod.
+const secretFilePrefix = "file:"
+
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Load reads the config file at path into out, which must be a pointer to a
+// struct. Files ending in .yaml or .yml are parsed as YAML, everything else as
+// JSON; both are decoded using the struct's json tags.
+//
+// Before decoding, every string value in the file is expanded:
+//   - ${VAR} is replaced with the value of the environment variable VAR
+//   - a value of the form file:<path> is replaced with the contents of that
+//     file, with surrounding whitespace removed. Relative paths are resolved
+//     against the directory of the config file.
+//
+// After decoding, fields that are still empty are set from their `default`
+// tag, and an error naming every missing field is returned if a field tagged
+// `required:"true"` is still empty.
+func Load(path string, out any) error {
+	_, err := load(path, out)
+	return err
+}
+
+// load is Load, but also returns the secret files the config file references,
+// even if loading it failed.
+func load(path string, out any) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file @ %s: %v", path, err)
+	}
+
+	var raw any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("error parsing yaml in config file @ %s: %v", path, err)
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("error parsing json in config file @ %s: %v", path, err)
+		}
+	}
+
+	e := &expander{baseDir: filepath.Dir(path)}
+	raw, err = e.expand(raw)
+	if err != nil {
+		return e.secretFiles, fmt.Errorf("error expanding config file @ %s: %v", path, err)
+	}
+
+	// round trip through json, so that yaml files are decoded with the same
+	// json tags as json files
+	expanded, err := json.Marshal(raw)
+	if err != nil {
+		return e.secretFiles, fmt.Errorf("error re-encoding config file @ %s: %v", path, err)
+	}
+	if err := json.Unmarshal(expanded, out); err != nil {
+		return e.secretFiles, fmt.Errorf("error unmarshaling config file @ %s: %v", path, err)
+	}
+
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return e.secretFiles, fmt.Errorf("config must be loaded into a pointer to a struct, got %T", out)
+	}
+	if err := applyDefaults(v.Elem()); err != nil {
+		return e.secretFiles, fmt.Errorf("error applying config defaults: %v", err)
+	}
+	if missing := missingRequired(v.Elem(), ""); len(missing) > 0 {
+		return e.secretFiles, fmt.Errorf("config file @ %s is missing required fields: %s", path, strings.Join(missing, ", "))
+	}
+
+	return e.secretFiles, nil
+}
+
+// expander substitutes environment variables and secret files in every string
+// value of a decoded config file, and remembers which secret files it read.
+type expander struct {
+	baseDir     string
+	secretFiles []string
+}
+
+func (e *expander) expand(raw any) (any, error) {
+	switch v := raw.(type) {
+	case map[string]any:
+		for key, value := range v {
+			expanded, err := e.expand(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			v[key] = expanded
+		}
+		return v, nil
+	case []any:
+		for i, value := range v {
+			expanded, err := e.expand(value)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			v[i] = expanded
+		}
+		return v, nil
+	case string:
+		return e.expandString(v)
+	default:
+		return v, nil
+	}
+}
+
+func (e *expander) expandString(value string) (string, error) {
+	var missing []string
+	value = envVarRe.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envVarRe.FindStringSubmatch(ref)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return envValue
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+
+	if !strings.HasPrefix(value, secretFilePrefix) {
+		return value, nil
+	}
+
+	secretPath := strings.TrimPrefix(value, secretFilePrefix)
+	if !filepath.IsAbs(secretPath) {
+		secretPath = filepath.Join(e.baseDir, secretPath)
+	}
+	e.secretFiles = append(e.secretFiles, secretPath)
+	secret, err := os.ReadFile(secretPath)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file: %v", err)
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
+
+func applyDefaults(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := applyDefaults(fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		def, ok := field.Tag.Lookup("default")
+		if !ok || !fv.IsZero() {
+			continue
+		}
+		if err := setFromString(fv, def); err != nil {
+			return fmt.Errorf("invalid default %q for %s: %v", def, field.Name, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, s string) error {
+	// durations are int64s, so they have to be checked before other ints
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("defaults are not supported for %s fields", v.Kind())
+	}
+	return nil
+}
+
+// missingRequired returns the json names of the required fields of v that are
+// empty, prefixed with the name of the struct they are nested in.
+func missingRequired(v reflect.Value, prefix string) []string {
+	var missing []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := prefix + jsonName(field)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			missing = append(missing, missingRequired(fv, name+".")...)
+			continue
+		}
+		if field.Tag.Get("required") == "true" && fv.IsZero() {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
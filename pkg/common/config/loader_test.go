@@ -0,0 +1,126 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	APIKey   string        `json:"api_key" required:"true"`
+	Site     string        `json:"site" default:"example.com"`
+	LogLevel string        `json:"log_level" default:"info"`
+	Workers  int           `json:"workers" default:"2"`
+	Interval time.Duration `json:"interval" default:"5m"`
+	Nested   struct {
+		Token string `json:"token" required:"true"`
+	} `json:"nested"`
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadJSON(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.json", `{"api_key": "abc", "site": "us5.example.com", "workers": 4, "nested": {"token": "xyz"}}`)
+
+	var cfg testConfig
+	if err := Load(path, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.APIKey != "abc" || cfg.Site != "us5.example.com" || cfg.Workers != 4 || cfg.Nested.Token != "xyz" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.LogLevel != "info" || cfg.Interval != 5*time.Minute {
+		t.Errorf("expected defaults to be applied, got %+v", cfg)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.yaml", "api_key: abc\nlog_level: debug\nnested:\n  token: xyz\n")
+
+	var cfg testConfig
+	if err := Load(path, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.APIKey != "abc" || cfg.LogLevel != "debug" || cfg.Nested.Token != "xyz" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.Site != "example.com" || cfg.Workers != 2 {
+		t.Errorf("expected defaults to be applied, got %+v", cfg)
+	}
+}
+
+func TestLoadEnvAndSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := writeFile(t, dir, "token", "from-secret\n")
+	writeFile(t, dir, "api-key", "relative-secret")
+	path := writeFile(t, dir, "config.json", `{"api_key": "file:api-key", "site": "${TEST_SITE_PREFIX}.example.com", "nested": {"token": "file:`+secretPath+`"}}`)
+	t.Setenv("TEST_SITE_PREFIX", "eu1")
+
+	var cfg testConfig
+	if err := Load(path, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.APIKey != "relative-secret" {
+		t.Errorf("expected api key from relative secret file, got %q", cfg.APIKey)
+	}
+	if cfg.Nested.Token != "from-secret" {
+		t.Errorf("expected token from secret file, got %q", cfg.Nested.Token)
+	}
+	if cfg.Site != "eu1.example.com" {
+		t.Errorf("expected site from environment, got %q", cfg.Site)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{
+			name:     "missing required fields",
+			contents: `{"site": "example.com"}`,
+			expected: "missing required fields: api_key, nested.token",
+		},
+		{
+			name:     "unset environment variable",
+			contents: `{"api_key": "${TEST_UNSET_VARIABLE}", "nested": {"token": "xyz"}}`,
+			expected: "api_key: environment variables not set: TEST_UNSET_VARIABLE",
+		},
+		{
+			name:     "missing secret file",
+			contents: `{"api_key": "file:/does/not/exist", "nested": {"token": "xyz"}}`,
+			expected: "api_key: error reading secret file",
+		},
+		{
+			name:     "invalid json",
+			contents: `{"api_key": "abc"`,
+			expected: "error parsing json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, dir, "config.json", tt.contents)
+			var cfg testConfig
+			err := Load(path, &cfg)
+			if err == nil {
+				t.Fatalf("expected an error, but got none")
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected error to contain %q, got %q", tt.expected, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"crypto/sha256"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/log"
+)
+
+// DefaultWatchInterval is how often the bundled plugins check their config
+// file and secret files for changes. Kubernetes takes up to a minute to update
+// mounted secrets anyway, so checking more often gains little.
+const DefaultWatchInterval = 30 * time.Second
+
+// Watcher reloads a config file whenever it, or one of the secret files it
+// references, changes.
+type Watcher struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Watch loads the config file at path into a new T and passes it to apply. It
+// then checks the config file and the secret files it references every
+// interval, and passes a freshly loaded T to apply whenever their contents
+// change. apply is never called concurrently, and should swap the plugin's
+// credentials and clients atomically so that in-flight requests finish on the
+// old config.
+//
+// Errors from the initial load or apply are returned. Later errors are logged
+// and the plugin keeps running on the last good config until the files change
+// again.
+func Watch[T any](path string, interval time.Duration, apply func(*T) error) (*Watcher, error) {
+	var cfg T
+	files, err := load(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := apply(&cfg); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	watched := fingerprint(path, files)
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+			}
+
+			if fingerprint(path, files) == watched {
+				continue
+			}
+
+			log.Infof("config file @ %s or its secret files changed, reloading", path)
+			var cfg T
+			files, err = load(path, &cfg)
+			// remember what was seen even if it is broken, so the same error
+			// isn't logged every interval
+			watched = fingerprint(path, files)
+			if err != nil {
+				log.Errorf("error reloading config, keeping the previous config: %v", err)
+				continue
+			}
+			if err := apply(&cfg); err != nil {
+				log.Errorf("error applying reloaded config, keeping the previous config: %v", err)
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// Stop stops watching for changes and waits for a reload in progress to finish.
+func (w *Watcher) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+// fingerprint hashes the contents of the config file and its secret files.
+// Contents are compared rather than modification times, because Kubernetes
+// updates mounted secrets by swapping symlinks.
+func fingerprint(path string, secretFiles []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, file := range append([]string{path}, secretFiles...) {
+		h.Write([]byte(file))
+		data, err := os.ReadFile(file)
+		if err != nil {
+			// a missing file is a state of its own, so that it is reloaded
+			// once the file appears
+			h.Write([]byte{0})
+			continue
+		}
+		h.Write([]byte{1})
+		h.Write(data)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type watchedConfig struct {
+	APIKey string `json:"api_key" required:"true"`
+	Site   string `json:"site"`
+}
+
+// recorder collects every config passed to apply by a Watcher.
+type recorder struct {
+	mu      sync.Mutex
+	configs []watchedConfig
+}
+
+func (r *recorder) apply(cfg *watchedConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.configs = append(r.configs, *cfg)
+	return nil
+}
+
+func (r *recorder) waitFor(t *testing.T, n int) []watchedConfig {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		configs := append([]watchedConfig{}, r.configs...)
+		r.mu.Unlock()
+		if len(configs) >= n {
+			return configs
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d configs to be applied", n)
+	return nil
+}
+
+func TestWatchReloadsConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.json", `{"api_key": "old"}`)
+
+	r := &recorder{}
+	w, err := Watch(path, 10*time.Millisecond, r.apply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	if configs := r.waitFor(t, 1); configs[0].APIKey != "old" {
+		t.Fatalf("expected initial config to be applied, got %+v", configs[0])
+	}
+
+	writeFile(t, dir, "config.json", `{"api_key": "new"}`)
+	if configs := r.waitFor(t, 2); configs[1].APIKey != "new" {
+		t.Errorf("expected reloaded config to be applied, got %+v", configs[1])
+	}
+}
+
+func TestWatchReloadsSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "api-key", "old")
+	path := writeFile(t, dir, "config.json", `{"api_key": "file:api-key"}`)
+
+	r := &recorder{}
+	w, err := Watch(path, 10*time.Millisecond, r.apply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	writeFile(t, dir, "api-key", "rotated")
+	if configs := r.waitFor(t, 2); configs[1].APIKey != "rotated" {
+		t.Errorf("expected rotated key to be applied, got %+v", configs[1])
+	}
+}
+
+func TestWatchKeepsConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config.json", `{"api_key": "old"}`)
+
+	r := &recorder{}
+	w, err := Watch(path, 10*time.Millisecond, r.apply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer w.Stop()
+
+	// a config without the required key must not be applied
+	writeFile(t, dir, "config.json", `{"site": "example.com"}`)
+	time.Sleep(50 * time.Millisecond)
+	writeFile(t, dir, "config.json", `{"api_key": "fixed"}`)
+
+	configs := r.waitFor(t, 2)
+	if len(configs) != 2 || configs[1].APIKey != "fixed" {
+		t.Errorf("expected only the valid configs to be applied, got %+v", configs)
+	}
+}
+
+func TestWatchInitialError(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "config.json", `{}`)
+
+	r := &recorder{}
+	if _, err := Watch(path, time.Hour, r.apply); err == nil {
+		t.Fatalf("expected an error, but got none")
+	}
+	if len(r.configs) != 0 {
+		t.Errorf("expected no config to be applied, got %+v", r.configs)
+	}
+}
@@ -0,0 +1,304 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/metrics"
+	"github.com/opencost/opencost-plugins/common/tracing"
+	"github.com/opencost/opencost/core/pkg/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultMaxRetries = 5
+	DefaultBaseDelay  = 1 * time.Second
+	DefaultMaxDelay   = 2 * time.Minute
+)
+
+// Config controls the retry and rate limiting behaviour of a Transport.
+// Zero values are replaced by the package defaults.
+type Config struct {
+	// MaxRetries is the number of times a request is retried after the first attempt.
+	MaxRetries int
+	// BaseDelay is the backoff before the first retry. It doubles on every
+	// following retry, up to MaxDelay.
+	BaseDelay time.Duration
+	// MaxDelay caps both the exponential backoff and any delay requested by
+	// the server through the Retry-After or X-RateLimit-Reset headers.
+	MaxDelay time.Duration
+	// HostLimiters holds the token bucket shared by every request to a host.
+	// Requests to hosts without an entry are not rate limited.
+	HostLimiters map[string]*rate.Limiter
+	// Routes are the path templates requests are counted under in the
+	// endpoint label of the API metrics, e.g.
+	// "/v1/organization/projects/{id}/api_keys". A segment in braces matches
+	// any segment. Requests whose path matches no route are counted under
+	// their path with every segment that isn't a word or an API version, such
+	// as an ID, replaced by "{id}", so IDs that look like words need a route.
+	Routes []string
+}
+
+// Transport is an http.RoundTripper that waits on a per-host token bucket
+// before each attempt and retries requests that fail with a retryable status
+// code, using exponential backoff with jitter unless the server says how long
+// to wait.
+type Transport struct {
+	base   http.RoundTripper
+	config Config
+}
+
+// NewTransport wraps base, or http.DefaultTransport if base is nil.
+func NewTransport(base http.RoundTripper, config Config) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+	if config.BaseDelay == 0 {
+		config.BaseDelay = DefaultBaseDelay
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = DefaultMaxDelay
+	}
+	return &Transport{
+		base:   base,
+		config: config,
+	}
+}
+
+// NewClient returns an http.Client that sends requests through a Transport
+// wrapping http.DefaultTransport.
+func NewClient(config Config) *http.Client {
+	return &http.Client{
+		Transport: NewTransport(nil, config),
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Hostname()),
+			attribute.String("url.path", req.URL.Path),
+		))
+	resp, err := t.roundTrip(ctx, req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	tracing.End(span, err)
+	return resp, err
+}
+
+// roundTrip sends req, waiting on the rate limiter before and retrying after
+// each attempt as needed. ctx is the context of the request's span.
+func (t *Transport) roundTrip(ctx context.Context, req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	limiter := t.config.HostLimiters[host]
+	endpoint := t.endpoint(req.URL.Path)
+
+	for attempt := 0; ; attempt++ {
+		if limiter != nil {
+			if limiter.Tokens() < 1.0 {
+				log.Debugf("rate limit reached for %s. holding request until rate capacity is back", host)
+			}
+			_, waitSpan := tracing.Tracer().Start(ctx, "rate limiter wait")
+			waitStart := time.Now()
+			err := limiter.Wait(ctx)
+			metrics.RateLimiterWait.WithLabelValues(host).Observe(time.Since(waitStart).Seconds())
+			tracing.End(waitSpan, err)
+			if err != nil {
+				return nil, fmt.Errorf("error waiting on rate limiter: %w", err)
+			}
+		}
+
+		attemptCtx, attemptSpan := tracing.Tracer().Start(ctx, "HTTP attempt",
+			trace.WithAttributes(attribute.Int("http.request.resend_count", attempt)))
+		attemptReq := req.WithContext(attemptCtx)
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				tracing.End(attemptSpan, err)
+				return nil, fmt.Errorf("error rewinding request body for retry: %w", err)
+			}
+			attemptReq = req.Clone(attemptCtx)
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+			attemptSpan.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(attemptSpan, err)
+		metrics.APIRequests.WithLabelValues(host, endpoint, status).Inc()
+		if attempt >= t.config.MaxRetries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		metrics.APIRetries.WithLabelValues(host, endpoint).Inc()
+
+		delay := t.retryDelay(resp, attempt)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.String("status", status),
+			attribute.String("delay", delay.String()),
+		))
+		if err != nil {
+			log.Warnf("error calling %s %s: %v. retrying in %s", req.Method, req.URL.Path, err, delay)
+		} else {
+			log.Warnf("got %d calling %s %s. retrying in %s", resp.StatusCode, req.Method, req.URL.Path, delay)
+			// drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// endpoint returns the template of path that requests to it are counted under
+// in the API metrics, so that IDs in paths don't make the number of label
+// values unbounded.
+func (t *Transport) endpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for _, route := range t.config.Routes {
+		if matchesRoute(segments, strings.Split(route, "/")) {
+			return route
+		}
+	}
+
+	for i, segment := range segments {
+		if segment != "" && !wordSegmentRe.MatchString(segment) && !versionSegmentRe.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+var (
+	wordSegmentRe    = regexp.MustCompile(`^[A-Za-z_-]+$`)
+	versionSegmentRe = regexp.MustCompile(`^v[0-9]+$`)
+)
+
+// matchesRoute reports whether the segments of a path match those of a route.
+func matchesRoute(segments, route []string) bool {
+	if len(segments) != len(route) {
+		return false
+	}
+	for i, segment := range route {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldRetry reports whether the outcome of an attempt is worth retrying.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	// a request body that can't be replayed can only be sent once
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return IsRetryableStatus(resp.StatusCode)
+}
+
+// IsRetryableStatus reports whether a response with the given status code
+// may succeed if the request is sent again.
+func IsRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns how long to wait before the next attempt. A delay
+// requested by the server wins over the exponential backoff.
+func (t *Transport) retryDelay(resp *http.Response, attempt int) time.Duration {
+	if resp != nil {
+		if delay, ok := serverDelay(resp.Header, time.Now()); ok {
+			return min(delay, t.config.MaxDelay)
+		}
+	}
+
+	// full jitter: pick uniformly between 0 and the exponential backoff
+	backoff := t.config.BaseDelay << attempt
+	if backoff <= 0 || backoff > t.config.MaxDelay {
+		backoff = t.config.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// serverDelay reads the delay requested by the server from the Retry-After
+// header, or from the X-RateLimit headers when the rate limit is exhausted.
+func serverDelay(header http.Header, now time.Time) (time.Duration, bool) {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(max(seconds, 0)) * time.Second, true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return max(date.Sub(now), 0), true
+		}
+	}
+
+	// Datadog sends X-RateLimit-Remaining and X-RateLimit-Reset, OpenAI sends
+	// X-RateLimit-Remaining-Requests and X-RateLimit-Reset-Requests
+	for _, suffix := range []string{"", "-Requests"} {
+		remaining := header.Get("X-RateLimit-Remaining" + suffix)
+		reset := header.Get("X-RateLimit-Reset" + suffix)
+		if remaining != "0" || reset == "" {
+			continue
+		}
+		if delay, ok := parseReset(reset); ok {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// parseReset parses a rate limit reset given either as a number of seconds
+// or as a duration such as "6m0s".
+func parseReset(reset string) (time.Duration, bool) {
+	reset = strings.TrimSpace(reset)
+	if seconds, err := strconv.ParseFloat(reset, 64); err == nil {
+		if seconds < 0 {
+			return 0, true
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if delay, err := time.ParseDuration(reset); err == nil {
+		return max(delay, 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,223 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func TestRetriesRetryableStatus(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	resp, err := client.Get(server.URL + "/retry")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+
+	serverURL, _ := url.Parse(server.URL)
+	if retries := testutil.ToFloat64(metrics.APIRetries.WithLabelValues(serverURL.Hostname(), "/retry")); retries != 2 {
+		t.Errorf("expected 2 retries to be counted, got %v", retries)
+	}
+	if failed := testutil.ToFloat64(metrics.APIRequests.WithLabelValues(serverURL.Hostname(), "/retry", "503")); failed != 2 {
+		t.Errorf("expected 2 failed requests to be counted, got %v", failed)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{BaseDelay: time.Millisecond})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("expected 1 call, got %d", calls.Load())
+	}
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{MaxRetries: 2, BaseDelay: time.Millisecond})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 calls, got %d", calls.Load())
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	limiter := rate.NewLimiter(rate.Every(50*time.Millisecond), 1)
+	client := NewClient(Config{
+		HostLimiters: map[string]*rate.Limiter{serverURL.Hostname(): limiter},
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// the first request uses the burst, the other two wait for a token each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected requests to be rate limited, took %s", elapsed)
+	}
+}
+
+func TestServerDelay(t *testing.T) {
+	now := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+		found    bool
+	}{
+		{
+			name:     "retry after seconds",
+			header:   http.Header{"Retry-After": []string{"7"}},
+			expected: 7 * time.Second,
+			found:    true,
+		},
+		{
+			name:     "retry after date",
+			header:   http.Header{"Retry-After": []string{now.Add(30 * time.Second).Format(http.TimeFormat)}},
+			expected: 30 * time.Second,
+			found:    true,
+		},
+		{
+			name: "datadog rate limit headers",
+			header: http.Header{
+				"X-Ratelimit-Remaining": []string{"0"},
+				"X-Ratelimit-Reset":     []string{"12"},
+			},
+			expected: 12 * time.Second,
+			found:    true,
+		},
+		{
+			name: "openai rate limit headers",
+			header: http.Header{
+				"X-Ratelimit-Remaining-Requests": []string{"0"},
+				"X-Ratelimit-Reset-Requests":     []string{"1m30s"},
+			},
+			expected: 90 * time.Second,
+			found:    true,
+		},
+		{
+			name: "rate limit not exhausted",
+			header: http.Header{
+				"X-Ratelimit-Remaining": []string{"4"},
+				"X-Ratelimit-Reset":     []string{"12"},
+			},
+			found: false,
+		},
+		{
+			name:   "no headers",
+			header: http.Header{},
+			found:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, found := serverDelay(tt.header, now)
+			if found != tt.found {
+				t.Fatalf("expected found to be %t, got %t", tt.found, found)
+			}
+			if delay != tt.expected {
+				t.Errorf("expected delay %s, got %s", tt.expected, delay)
+			}
+		})
+	}
+}
+
+func TestRetryDelayIsCapped(t *testing.T) {
+	transport := NewTransport(nil, Config{BaseDelay: time.Second, MaxDelay: 5 * time.Second})
+
+	for attempt := 0; attempt < 10; attempt++ {
+		if delay := transport.retryDelay(nil, attempt); delay > 5*time.Second {
+			t.Errorf("attempt %d: expected delay to be capped at 5s, got %s", attempt, delay)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+	if delay := transport.retryDelay(resp, 0); delay != 5*time.Second {
+		t.Errorf("expected Retry-After to be capped at 5s, got %s", delay)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	transport := NewTransport(nil, Config{Routes: []string{"/v1/organization/projects/{project_id}/api_keys"}})
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/v2/usage/hourly_usage", "/api/v2/usage/hourly_usage"},
+		{"/v1/organization/projects/proj_web/api_keys", "/v1/organization/projects/{project_id}/api_keys"},
+		{"/v1/organization/projects", "/v1/organization/projects"},
+		{"/api/atlas/v2/orgs/5f1a2b3c4d5e6f7a8b9c0d1e/invoices/pending", "/api/atlas/v2/orgs/{id}/invoices/pending"},
+		{"/api/v2/cost/custom_costs/0b3e1c52-7c1a-4a1e-9f0e-2c5d8e1f4a6b", "/api/v2/cost/custom_costs/{id}"},
+	}
+	for _, tt := range tests {
+		if endpoint := transport.endpoint(tt.path); endpoint != tt.expected {
+			t.Errorf("%s: expected endpoint %s, got %s", tt.path, tt.expected, endpoint)
+		}
+	}
+}
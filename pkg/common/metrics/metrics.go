@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Window fetch results, used as the result label of WindowsFetched.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+	ResultCached  = "cached"
+)
+
+var (
+	// APIRequests counts every attempt to call a cost source's API, including
+	// retries. status is the HTTP status code, or "error" if no response was
+	// received.
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opencost_plugin_api_requests_total",
+		Help: "Number of requests sent to the cost source API, by host, endpoint and status.",
+	}, []string{"host", "endpoint", "status"})
+
+	// APIRetries counts the requests that were sent again after failing.
+	APIRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opencost_plugin_api_retries_total",
+		Help: "Number of retried requests to the cost source API, by host and endpoint.",
+	}, []string{"host", "endpoint"})
+
+	// RateLimiterWait observes how long requests were held by the rate limiter.
+	RateLimiterWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "opencost_plugin_rate_limiter_wait_seconds",
+		Help:    "Time requests spent waiting on the rate limiter, by host.",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300},
+	}, []string{"host"})
+
+	// WindowsFetched counts windows by whether they were fetched, failed or
+	// served from the cache.
+	WindowsFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "opencost_plugin_windows_fetched_total",
+		Help: "Number of windows returned to OpenCost, by result.",
+	}, []string{"result"})
+
+	// CostsEmitted counts the custom costs returned to OpenCost.
+	CostsEmitted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "opencost_plugin_costs_emitted_total",
+		Help: "Number of custom costs returned to OpenCost.",
+	})
+
+	// WindowErrors counts the errors reported in window responses.
+	WindowErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "opencost_plugin_window_errors_total",
+		Help: "Number of errors reported in the responses for windows.",
+	})
+
+	// LastSuccessfulFetch is the time the last window was fetched without errors.
+	LastSuccessfulFetch = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "opencost_plugin_last_successful_fetch_timestamp_seconds",
+		Help: "Unix time the last window was fetched without errors.",
+	})
+)
+
+var (
+	serveMu   sync.Mutex
+	servePort int
+)
+
+// Serve exposes the metrics, labelled with the plugin's name, on /metrics at
+// the given port. It does nothing if port is zero. The port can't be changed
+// once the server is listening, so later calls with another port only log a
+// warning; this lets plugins call it every time their config is reloaded.
+func Serve(plugin string, port int) error {
+	if port == 0 {
+		return nil
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	if servePort != 0 {
+		if port != servePort {
+			log.Warnf("metrics are already served on port %d, restart the plugin to serve them on port %d", servePort, port)
+		}
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("error listening for metrics on port %d: %v", port, err)
+	}
+
+	registry, err := newRegistry(plugin)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Errorf("error serving metrics: %v", err)
+		}
+	}()
+
+	servePort = port
+	log.Infof("serving metrics on port %d", port)
+	return nil
+}
+
+// newRegistry returns a registry with every plugin metric, labelled with the
+// plugin's name.
+func newRegistry(plugin string) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"plugin": plugin}, registry)
+	for _, c := range []prometheus.Collector{
+		APIRequests,
+		APIRetries,
+		RateLimiterWait,
+		WindowsFetched,
+		CostsEmitted,
+		WindowErrors,
+		LastSuccessfulFetch,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, fmt.Errorf("error registering metrics: %v", err)
+		}
+	}
+	return registry, nil
+}
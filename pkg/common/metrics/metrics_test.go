@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestServe(t *testing.T) {
+	if err := Serve("test", 0); err != nil {
+		t.Fatalf("expected a zero port to disable metrics, got %v", err)
+	}
+
+	port := freePort(t)
+	if err := Serve("test", port); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// reloading the config must not try to listen again
+	if err := Serve("test", port); err != nil {
+		t.Fatalf("unexpected error serving metrics twice: %v", err)
+	}
+
+	APIRequests.WithLabelValues("api.example.com", "/v1/usage", "200").Inc()
+	WindowsFetched.WithLabelValues(ResultSuccess).Inc()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", port))
+	if err != nil {
+		t.Fatalf("error scraping metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+
+	for _, expected := range []string{
+		`opencost_plugin_api_requests_total{endpoint="/v1/usage",host="api.example.com",plugin="test",status="200"} 1`,
+		`opencost_plugin_windows_fetched_total{plugin="test",result="success"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected metrics to contain %s, got:\n%s", expected, body)
+		}
+	}
+}
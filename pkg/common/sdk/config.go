@@ -0,0 +1,76 @@
+package sdk
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/cache"
+	"github.com/opencost/opencost-plugins/common/metrics"
+	"github.com/opencost/opencost-plugins/common/tracing"
+)
+
+// Config holds the settings of the SDK that every plugin shares. Plugin
+// configs embed it, so its fields are set at the top level of their config
+// files.
+type Config struct {
+	// CacheDir enables caching responses for finalized windows on disk
+	CacheDir string `json:"cache_dir"`
+	// CacheRestatementHorizon overrides how long after a window ends its costs
+	// are refetched, e.g. "72h"
+	CacheRestatementHorizon string `json:"cache_restatement_horizon"`
+	// RequestTimeout bounds how long a single request from OpenCost may take,
+	// e.g. "30m". By default it grows with the number of windows requested.
+	RequestTimeout string `json:"request_timeout"`
+	// Parallelism is the number of windows fetched at the same time. All
+	// fetches share the plugin's rate limit. Defaults to 1.
+	Parallelism int `json:"parallelism"`
+	// MetricsPort enables serving Prometheus metrics on /metrics at this port.
+	// It only takes effect when the plugin starts.
+	MetricsPort int `json:"metrics_port"`
+	// TracingEndpoint enables exporting OpenTelemetry spans over OTLP/HTTP to
+	// this collector, e.g. "http://otel-collector:4318". It only takes effect
+	// when the plugin starts.
+	TracingEndpoint string `json:"tracing_endpoint"`
+}
+
+// NewCostSource returns a CostSource for the named plugin with the cache,
+// timeout and parallelism in config, but no Fetch, which the plugin sets
+// before serving a request with it. defaultHorizon is how long the plugin's
+// vendor may restate costs for when config doesn't override it.
+func NewCostSource(name string, config Config, defaultHorizon time.Duration) (*CostSource, error) {
+	responseCache, err := cache.New(cache.Config{
+		Dir:                config.CacheDir,
+		RestatementHorizon: config.CacheRestatementHorizon,
+	}, defaultHorizon)
+	if err != nil {
+		return nil, fmt.Errorf("error creating response cache: %v", err)
+	}
+
+	var timeout time.Duration
+	if config.RequestTimeout != "" {
+		timeout, err = time.ParseDuration(config.RequestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing request timeout: %v", err)
+		}
+	}
+
+	return &CostSource{
+		Name:        name,
+		Cache:       responseCache,
+		Timeout:     timeout,
+		Parallelism: config.Parallelism,
+	}, nil
+}
+
+// StartTelemetry serves the named plugin's metrics and exports its spans if
+// config enables them. Both only start the first time it is called, so it can
+// be called again whenever the config is reloaded.
+func StartTelemetry(name string, config Config) error {
+	if err := metrics.Serve(name, config.MetricsPort); err != nil {
+		return err
+	}
+	if _, err := tracing.Start(name, config.TracingEndpoint); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package sdk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewCostSource(t *testing.T) {
+	src, err := NewCostSource("test", Config{}, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if src.Name != "test" || src.Cache != nil || src.Timeout != 0 || src.Parallelism != 0 {
+		t.Errorf("expected a cost source with the defaults, got %+v", src)
+	}
+
+	src, err = NewCostSource("test", Config{
+		CacheDir:       t.TempDir(),
+		RequestTimeout: "30m",
+		Parallelism:    4,
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if src.Cache == nil {
+		t.Errorf("expected a cache")
+	}
+	if src.Timeout != 30*time.Minute {
+		t.Errorf("expected a 30m timeout, got %s", src.Timeout)
+	}
+	if src.Parallelism != 4 {
+		t.Errorf("expected a parallelism of 4, got %d", src.Parallelism)
+	}
+
+	if _, err := NewCostSource("test", Config{RequestTimeout: "soon"}, time.Hour); err == nil {
+		t.Errorf("expected an error for an invalid request timeout")
+	}
+	if _, err := NewCostSource("test", Config{CacheDir: t.TempDir(), CacheRestatementHorizon: "later"}, time.Hour); err == nil {
+		t.Errorf("expected an error for an invalid restatement horizon")
+	}
+}
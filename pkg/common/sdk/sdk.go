@@ -0,0 +1,263 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-plugin"
+	"github.com/opencost/opencost-plugins/common/cache"
+	"github.com/opencost/opencost-plugins/common/metrics"
+	"github.com/opencost/opencost-plugins/common/tracing"
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	ocplugin "github.com/opencost/opencost/core/pkg/plugin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultWindowTimeout is the time allowed per window when a CostSource has
+// no Timeout, so a request's deadline grows with the number of windows in it.
+const DefaultWindowTimeout = 5 * time.Minute
+
+// FetchFunc retrieves the costs for a single window. An error is reported in
+// the response for that window only; the remaining windows are still fetched.
+// ctx carries the deadline of the request and must be passed to every API call.
+type FetchFunc func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error)
+
+// CostSource is an implementation of CustomCostSource that splits each request
+// into windows of the requested resolution and fetches them with a bounded
+// number of workers.
+type CostSource struct {
+	// Name is the name of the plugin. It is used as the domain of the error
+	// responses built by the SDK.
+	Name string
+	// Fetch is called for every window of the request that has already started.
+	Fetch FetchFunc
+	// Cache is optional. Responses for finalized windows are served from it
+	// instead of being fetched again.
+	Cache *cache.Cache
+	// Timeout is the deadline for a whole request. Windows that haven't been
+	// fetched when it expires get a timeout error instead. If it is zero, each
+	// window in the request adds DefaultWindowTimeout to the deadline.
+	Timeout time.Duration
+	// Parallelism is the number of windows fetched at the same time. Windows
+	// are fetched one at a time if it is zero. Concurrent fetches should go
+	// through the plugin's rate limited HTTP client, so that they share the
+	// vendor's quota instead of exceeding it.
+	Parallelism int
+}
+
+func (c *CostSource) GetCustomCosts(req *pb.CustomCostRequest) []*pb.CustomCostResponse {
+	results := []*pb.CustomCostResponse{}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "GetCustomCosts", trace.WithAttributes(
+		attribute.String("plugin", c.Name),
+		attribute.String("request.start", req.Start.AsTime().String()),
+		attribute.String("request.end", req.End.AsTime().String()),
+		attribute.String("request.resolution", req.Resolution.AsDuration().String()),
+	))
+	defer span.End()
+
+	targets, err := opencost.GetWindows(req.Start.AsTime(), req.End.AsTime(), req.Resolution.AsDuration())
+	if err != nil {
+		log.Errorf("error getting windows: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		errResp := pb.CustomCostResponse{
+			Domain: c.Name,
+			Errors: []string{fmt.Sprintf("error getting windows: %v", err)},
+		}
+		results = append(results, &errResp)
+		return results
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(len(targets)) * DefaultWindowTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	parallelism := c.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	// workers store each response at the index of its window, so responses are
+	// returned in window order no matter which fetch finishes first
+	responses := make([]*pb.CustomCostResponse, len(targets))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(parallelism, len(targets)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				responses[idx] = c.getWindow(ctx, targets[idx], req.Resolution.AsDuration(), timeout)
+			}
+		}()
+	}
+
+	for i, target := range targets {
+		// cost sources can't tell the future, so don't ask them to
+		if target.Start().After(time.Now().UTC()) {
+			log.Debugf("skipping future window %v", target)
+			continue
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, result := range responses {
+		if result == nil {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func (c *CostSource) getWindow(ctx context.Context, target opencost.Window, resolution, timeout time.Duration) *pb.CustomCostResponse {
+	ctx, span := tracing.Tracer().Start(ctx, "window", trace.WithAttributes(
+		attribute.String("window.start", target.Start().String()),
+		attribute.String("window.end", target.End().String()),
+	))
+	defer span.End()
+
+	var result *pb.CustomCostResponse
+	if ctx.Err() != nil {
+		err := fmt.Errorf("request timed out after %s before window could be fetched: %v", timeout, ctx.Err())
+		metrics.WindowsFetched.WithLabelValues(metrics.ResultError).Inc()
+		metrics.WindowErrors.Inc()
+		result = ErrorResponse(c.Name, target, err)
+	} else {
+		result = c.fetchWindow(ctx, target, resolution)
+	}
+
+	if result != nil {
+		span.SetAttributes(
+			attribute.Int("costs", len(result.Costs)),
+			attribute.Int("errors", len(result.Errors)),
+		)
+		if len(result.Errors) > 0 {
+			span.SetStatus(codes.Error, strings.Join(result.Errors, "; "))
+		}
+	}
+	return result
+}
+
+func (c *CostSource) fetchWindow(ctx context.Context, target opencost.Window, resolution time.Duration) *pb.CustomCostResponse {
+	if c.Cache != nil {
+		if cached, ok := c.Cache.Get(c.Name, target, resolution); ok {
+			log.Debugf("using cached %s costs for window %v", c.Name, target)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("cached", true))
+			metrics.WindowsFetched.WithLabelValues(metrics.ResultCached).Inc()
+			metrics.CostsEmitted.Add(float64(len(cached.Costs)))
+			return cached
+		}
+	}
+
+	log.Debugf("fetching %s costs for window %v", c.Name, target)
+	result, err := c.Fetch(ctx, target)
+	if err != nil {
+		log.Errorf("error fetching %s costs for window %v: %v", c.Name, target, err)
+		metrics.WindowsFetched.WithLabelValues(metrics.ResultError).Inc()
+		metrics.WindowErrors.Inc()
+		return ErrorResponse(c.Name, target, err)
+	}
+	recordFetched(result)
+
+	if c.Cache != nil && result != nil {
+		if err := c.Cache.Put(c.Name, target, resolution, result); err != nil {
+			log.Warnf("error caching %s costs for window %v: %v", c.Name, target, err)
+		}
+	}
+	return result
+}
+
+// recordFetched updates the window metrics for a response returned by Fetch.
+// Fetch may report errors in the response itself rather than failing.
+func recordFetched(result *pb.CustomCostResponse) {
+	if result == nil {
+		return
+	}
+	metrics.CostsEmitted.Add(float64(len(result.Costs)))
+	if len(result.Errors) > 0 {
+		metrics.WindowsFetched.WithLabelValues(metrics.ResultError).Inc()
+		metrics.WindowErrors.Add(float64(len(result.Errors)))
+		return
+	}
+	metrics.WindowsFetched.WithLabelValues(metrics.ResultSuccess).Inc()
+	metrics.LastSuccessfulFetch.SetToCurrentTime()
+}
+
+// ErrorResponse builds the response reported for a window whose costs could
+// not be fetched.
+func ErrorResponse(domain string, window opencost.Window, err error) *pb.CustomCostResponse {
+	return &pb.CustomCostResponse{
+		Domain: domain,
+		Start:  timestamppb.New(*window.Start()),
+		End:    timestamppb.New(*window.End()),
+		Errors: []string{err.Error()},
+		Costs:  []*pb.CustomCost{},
+	}
+}
+
+// SwappableSource is a CustomCostSource that serves every request from the
+// source it was last given, so that a plugin can replace its credentials and
+// clients when its config is reloaded. Requests that are in flight when the
+// source is swapped finish on the old one.
+type SwappableSource struct {
+	current atomic.Pointer[ocplugin.CustomCostSource]
+}
+
+// Store makes src serve all requests from now on.
+func (s *SwappableSource) Store(src ocplugin.CustomCostSource) {
+	s.current.Store(&src)
+}
+
+func (s *SwappableSource) GetCustomCosts(req *pb.CustomCostRequest) []*pb.CustomCostResponse {
+	src := s.current.Load()
+	if src == nil {
+		log.Errorf("no cost source has been stored yet")
+		return []*pb.CustomCostResponse{}
+	}
+	return (*src).GetCustomCosts(req)
+}
+
+// HandshakeConfig returns the handshake config for the named plugin.
+// handshakeConfigs are used to just do a basic handshake between
+// a plugin and host. If the handshake fails, a user friendly error is shown.
+// This prevents users from executing bad plugins or executing a plugin
+// directory. It is a UX feature, not a security feature.
+func HandshakeConfig(name string) plugin.HandshakeConfig {
+	return plugin.HandshakeConfig{
+		ProtocolVersion:  1,
+		MagicCookieKey:   "PLUGIN_NAME",
+		MagicCookieValue: name,
+	}
+}
+
+// Serve serves src to OpenCost as the named plugin. It blocks until the host
+// process kills the plugin.
+func Serve(name string, src ocplugin.CustomCostSource) {
+	// pluginMap is the map of plugins we can dispense.
+	var pluginMap = map[string]plugin.Plugin{
+		"CustomCostSource": &ocplugin.CustomCostPlugin{Impl: src},
+	}
+
+	plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: HandshakeConfig(name),
+		Plugins:         pluginMap,
+		GRPCServer:      plugin.DefaultGRPCServer,
+	})
+}
@@ -0,0 +1,345 @@
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/cache"
+	"github.com/opencost/opencost-plugins/common/metrics"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestGetCustomCostsSplitsWindows(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 4, 0, 0, 0, 0, time.UTC)
+
+	fetched := []opencost.Window{}
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			fetched = append(fetched, window)
+			return &pb.CustomCostResponse{
+				Domain: "test",
+				Start:  timestamppb.New(*window.Start()),
+				End:    timestamppb.New(*window.End()),
+			}, nil
+		},
+	}
+
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if len(resp) != 3 || len(fetched) != 3 {
+		t.Fatalf("expected 3 responses and 3 fetches, got %d and %d", len(resp), len(fetched))
+	}
+	for i, r := range resp {
+		expectedStart := windowStart.AddDate(0, 0, i)
+		if !r.Start.AsTime().Equal(expectedStart) {
+			t.Errorf("expected response %d to start at %s, got %s", i, expectedStart, r.Start.AsTime())
+		}
+	}
+}
+
+func TestGetCustomCostsSkipsFutureWindows(t *testing.T) {
+	windowStart := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	windowEnd := windowStart.Add(2 * time.Hour)
+
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			t.Fatalf("unexpected fetch for future window %v", window)
+			return nil, nil
+		},
+	}
+
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(time.Hour),
+	})
+
+	if len(resp) != 0 {
+		t.Fatalf("expected no responses for future windows, got %d", len(resp))
+	}
+}
+
+func TestGetCustomCostsErrorPerWindow(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 3, 0, 0, 0, 0, time.UTC)
+
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			if window.Start().Equal(windowStart) {
+				return nil, fmt.Errorf("mock error")
+			}
+			return &pb.CustomCostResponse{Domain: "test"}, nil
+		},
+	}
+
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if len(resp) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resp))
+	}
+	if len(resp[0].Errors) != 1 || resp[0].Errors[0] != "mock error" {
+		t.Errorf("expected error in first window, got %v", resp[0].Errors)
+	}
+	if resp[0].Domain != "test" || !resp[0].Start.AsTime().Equal(windowStart) {
+		t.Errorf("expected error response to carry domain and window, got %v", resp[0])
+	}
+	if len(resp[1].Errors) != 0 {
+		t.Errorf("expected no errors in second window, got %v", resp[1].Errors)
+	}
+}
+
+func TestGetCustomCostsBadWindow(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			t.Fatalf("unexpected fetch for window %v", window)
+			return nil, nil
+		},
+	}
+
+	// a 5 hour range can't be split into daily windows
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowStart.Add(5 * time.Hour)),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if len(resp) != 1 || len(resp[0].Errors) == 0 {
+		t.Fatalf("expected a single error response, got %v", resp)
+	}
+}
+
+func TestGetCustomCostsUsesCache(t *testing.T) {
+	responseCache, err := cache.New(cache.Config{Dir: t.TempDir()}, 72*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 3, 0, 0, 0, 0, time.UTC)
+	req := &pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	}
+
+	fetches := 0
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			fetches++
+			return &pb.CustomCostResponse{
+				Domain: "test",
+				Start:  timestamppb.New(*window.Start()),
+				End:    timestamppb.New(*window.End()),
+			}, nil
+		},
+		Cache: responseCache,
+	}
+
+	first := src.GetCustomCosts(req)
+	second := src.GetCustomCosts(req)
+
+	if fetches != 2 {
+		t.Errorf("expected 2 fetches, got %d", fetches)
+	}
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("expected 2 responses per request, got %d and %d", len(first), len(second))
+	}
+	for i := range second {
+		if !second[i].Start.AsTime().Equal(first[i].Start.AsTime()) {
+			t.Errorf("expected cached response %d to match fetched response", i)
+		}
+	}
+}
+
+func TestGetCustomCostsTimeout(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 4, 0, 0, 0, 0, time.UTC)
+
+	fetches := 0
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			fetches++
+			// the first window uses up the whole deadline
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		Timeout: 10 * time.Millisecond,
+	}
+
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if fetches != 1 {
+		t.Errorf("expected only the first window to be fetched, got %d fetches", fetches)
+	}
+	if len(resp) != 3 {
+		t.Fatalf("expected 3 responses, got %d", len(resp))
+	}
+	for i, r := range resp {
+		if len(r.Errors) != 1 {
+			t.Errorf("expected a timeout error for window %d, got %v", i, r.Errors)
+		}
+		if !r.Start.AsTime().Equal(windowStart.AddDate(0, 0, i)) {
+			t.Errorf("expected response %d to start at %s, got %s", i, windowStart.AddDate(0, 0, i), r.Start.AsTime())
+		}
+	}
+}
+
+func TestGetCustomCostsParallelism(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 11, 0, 0, 0, 0, time.UTC)
+
+	var inFlight, maxInFlight atomic.Int32
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			// earlier windows take longer, so they finish after later ones
+			days := window.Start().Sub(windowStart) / (24 * time.Hour)
+			time.Sleep(time.Duration(10-days) * 2 * time.Millisecond)
+			return &pb.CustomCostResponse{
+				Domain: "test",
+				Start:  timestamppb.New(*window.Start()),
+				End:    timestamppb.New(*window.End()),
+			}, nil
+		},
+		Parallelism: 3,
+	}
+
+	resp := src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if len(resp) != 10 {
+		t.Fatalf("expected 10 responses, got %d", len(resp))
+	}
+	for i, r := range resp {
+		expectedStart := windowStart.AddDate(0, 0, i)
+		if !r.Start.AsTime().Equal(expectedStart) {
+			t.Errorf("expected response %d to start at %s, got %s", i, expectedStart, r.Start.AsTime())
+		}
+	}
+	if maxInFlight.Load() > 3 {
+		t.Errorf("expected at most 3 concurrent fetches, got %d", maxInFlight.Load())
+	}
+	if maxInFlight.Load() < 2 {
+		t.Errorf("expected windows to be fetched concurrently, got %d concurrent fetches", maxInFlight.Load())
+	}
+}
+
+func TestSwappableSource(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	req := &pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowStart.AddDate(0, 0, 1)),
+		Resolution: durationpb.New(24 * time.Hour),
+	}
+	sourceFor := func(domain string) *CostSource {
+		return &CostSource{
+			Name: domain,
+			Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+				return &pb.CustomCostResponse{Domain: domain}, nil
+			},
+		}
+	}
+
+	src := &SwappableSource{}
+	if resp := src.GetCustomCosts(req); len(resp) != 0 {
+		t.Fatalf("expected no responses before a source is stored, got %v", resp)
+	}
+
+	src.Store(sourceFor("old"))
+	if resp := src.GetCustomCosts(req); len(resp) != 1 || resp[0].Domain != "old" {
+		t.Fatalf("expected response from the old source, got %v", resp)
+	}
+
+	src.Store(sourceFor("new"))
+	if resp := src.GetCustomCosts(req); len(resp) != 1 || resp[0].Domain != "new" {
+		t.Fatalf("expected response from the new source, got %v", resp)
+	}
+}
+
+func TestGetCustomCostsMetrics(t *testing.T) {
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	windowEnd := time.Date(2024, 10, 4, 0, 0, 0, 0, time.UTC)
+
+	src := CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			switch {
+			case window.Start().Equal(windowStart):
+				return nil, fmt.Errorf("mock error")
+			case window.Start().Equal(windowStart.AddDate(0, 0, 1)):
+				return &pb.CustomCostResponse{Domain: "test", Errors: []string{"partial", "failure"}}, nil
+			default:
+				return &pb.CustomCostResponse{
+					Domain: "test",
+					Costs:  []*pb.CustomCost{{ResourceName: "a"}, {ResourceName: "b"}},
+				}, nil
+			}
+		},
+	}
+
+	errorsBefore := testutil.ToFloat64(metrics.WindowErrors)
+	costsBefore := testutil.ToFloat64(metrics.CostsEmitted)
+	failedBefore := testutil.ToFloat64(metrics.WindowsFetched.WithLabelValues(metrics.ResultError))
+	succeededBefore := testutil.ToFloat64(metrics.WindowsFetched.WithLabelValues(metrics.ResultSuccess))
+
+	src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowEnd),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if diff := testutil.ToFloat64(metrics.WindowErrors) - errorsBefore; diff != 3 {
+		t.Errorf("expected 3 window errors, got %v", diff)
+	}
+	if diff := testutil.ToFloat64(metrics.CostsEmitted) - costsBefore; diff != 2 {
+		t.Errorf("expected 2 costs emitted, got %v", diff)
+	}
+	if diff := testutil.ToFloat64(metrics.WindowsFetched.WithLabelValues(metrics.ResultError)) - failedBefore; diff != 2 {
+		t.Errorf("expected 2 failed windows, got %v", diff)
+	}
+	if diff := testutil.ToFloat64(metrics.WindowsFetched.WithLabelValues(metrics.ResultSuccess)) - succeededBefore; diff != 1 {
+		t.Errorf("expected 1 successful window, got %v", diff)
+	}
+	if testutil.ToFloat64(metrics.LastSuccessfulFetch) == 0 {
+		t.Errorf("expected last successful fetch time to be set")
+	}
+}
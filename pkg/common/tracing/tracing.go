@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/opencost/opencost/core/pkg/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/opencost/opencost-plugins/common"
+
+var (
+	startMu       sync.Mutex
+	startEndpoint string
+	provider      *sdktrace.TracerProvider
+)
+
+// Tracer returns the tracer used for all plugin spans. Spans are dropped until
+// Start has been called with an endpoint.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start exports the plugin's spans over OTLP/HTTP to endpoint, e.g.
+// "http://otel-collector:4318". It does nothing if endpoint is empty. The
+// endpoint can't be changed once spans are exported, so later calls with
+// another endpoint only log a warning; this lets plugins call it every time
+// their config is reloaded.
+//
+// The returned function flushes any buffered spans and stops exporting.
+func Start(plugin string, endpoint string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if endpoint == "" {
+		return noop, nil
+	}
+
+	startMu.Lock()
+	defer startMu.Unlock()
+	if provider != nil {
+		if endpoint != startEndpoint {
+			log.Warnf("spans are already exported to %s, restart the plugin to export them to %s", startEndpoint, endpoint)
+		}
+		return provider.Shutdown, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return noop, fmt.Errorf("error creating OTLP exporter for %s: %v", endpoint, err)
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "opencost-plugin-"+plugin),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	startEndpoint = endpoint
+
+	log.Infof("exporting spans to %s", endpoint)
+	return provider.Shutdown, nil
+}
+
+// End ends span, marking it as failed if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,147 @@
+package tracing_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/httpclient"
+	"github.com/opencost/opencost-plugins/common/sdk"
+	"github.com/opencost/opencost-plugins/common/tracing"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector that records the names
+// of the spans it receives.
+type collector struct {
+	mu    sync.Mutex
+	spans map[string]int
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var export coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &export); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	for _, resourceSpans := range export.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				c.spans[span.Name]++
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	response, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(response)
+}
+
+func TestSpansExportedToCollector(t *testing.T) {
+	c := &collector{spans: map[string]int{}}
+	collectorServer := httptest.NewServer(c)
+	defer collectorServer.Close()
+
+	shutdown, err := tracing.Start("test", collectorServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the vendor API fails once, so the request is retried
+	var calls int
+	var callsMu sync.Mutex
+	vendor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callsMu.Lock()
+		defer callsMu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer vendor.Close()
+
+	vendorURL, _ := url.Parse(vendor.URL)
+	client := httpclient.NewClient(httpclient.Config{
+		BaseDelay: time.Millisecond,
+		HostLimiters: map[string]*rate.Limiter{
+			vendorURL.Hostname(): rate.NewLimiter(rate.Inf, 1),
+		},
+	})
+
+	src := sdk.CostSource{
+		Name: "test",
+		Fetch: func(ctx context.Context, window opencost.Window) (*pb.CustomCostResponse, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, vendor.URL+"/usage", nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			return &pb.CustomCostResponse{Domain: "test"}, nil
+		},
+	}
+
+	windowStart := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	src.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowStart.AddDate(0, 0, 2)),
+		Resolution: durationpb.New(24 * time.Hour),
+	})
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("error flushing spans: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expected := map[string]int{
+		"GetCustomCosts":    1,
+		"window":            2,
+		"HTTP GET":          2,
+		"HTTP attempt":      3,
+		"rate limiter wait": 3,
+	}
+	for name, count := range expected {
+		if c.spans[name] != count {
+			t.Errorf("expected %d %q spans, got %d (all spans: %v)", count, name, c.spans[name], c.spans)
+		}
+	}
+}
+
+func TestStartWithoutEndpoint(t *testing.T) {
+	shutdown, err := tracing.Start("test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
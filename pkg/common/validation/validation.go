@@ -0,0 +1,154 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ChargeCategories are the ChargeCategory values allowed by FOCUS.
+var ChargeCategories = map[string]bool{
+	"Usage":      true,
+	"Purchase":   true,
+	"Tax":        true,
+	"Credit":     true,
+	"Adjustment": true,
+}
+
+// currencyRe matches ISO 4217 currency codes.
+var currencyRe = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Billed costs may exceed list costs by a cent, since vendors round billed
+// costs, or by a small fraction of the list cost to allow for float32 rounding.
+const (
+	centTolerance     = 0.01
+	relativeTolerance = 1e-4
+)
+
+// Unmarshal parses the JSON array of responses the integration test harness
+// writes for each resolution.
+func Unmarshal(data []byte) ([]*pb.CustomCostResponse, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	protoResps := make([]*pb.CustomCostResponse, len(raw))
+	for i, r := range raw {
+		p := &pb.CustomCostResponse{}
+		if err := protojson.Unmarshal(r, p); err != nil {
+			return nil, err
+		}
+		protoResps[i] = p
+	}
+
+	return protoResps, nil
+}
+
+// ValidateResponses validates every response with ValidateResponse, and
+// returns all problems found.
+func ValidateResponses(resps []*pb.CustomCostResponse, domain string, resolution time.Duration) error {
+	var multiErr error
+	for _, resp := range resps {
+		if err := ValidateResponse(resp, domain, resolution); err != nil {
+			multiErr = multierror.Append(multiErr, err)
+		}
+	}
+	return multiErr
+}
+
+// ValidateResponse checks that resp reports no errors, belongs to domain,
+// covers a single window of the given resolution aligned to it, and that every
+// cost in it passes ValidateCost and has an ID no other cost in resp has.
+func ValidateResponse(resp *pb.CustomCostResponse, domain string, resolution time.Duration) error {
+	var multiErr error
+	fail := func(format string, args ...any) {
+		multiErr = multierror.Append(multiErr, fmt.Errorf(format, args...))
+	}
+
+	if resp.Start == nil || resp.End == nil {
+		fail("response has no window: start %v, end %v", resp.Start, resp.End)
+		return multiErr
+	}
+	start := resp.Start.AsTime()
+	end := resp.End.AsTime()
+	window := fmt.Sprintf("window %s - %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	if len(resp.Errors) > 0 {
+		fail("%s: errors occurred in response: %v", window, resp.Errors)
+	}
+	if resp.Domain != domain {
+		fail("%s: domain %q does not match plugin name %q", window, resp.Domain, domain)
+	}
+	if end.Sub(start) != resolution {
+		fail("%s: window is %s long, expected %s", window, end.Sub(start), resolution)
+	}
+	if !start.Truncate(resolution).Equal(start) {
+		fail("%s: window start is not aligned to %s", window, resolution)
+	}
+	if !currencyRe.MatchString(resp.Currency) {
+		fail("%s: currency %q is not an ISO 4217 code", window, resp.Currency)
+	}
+
+	seenIDs := map[string]bool{}
+	for _, cost := range resp.Costs {
+		if err := ValidateCost(cost); err != nil {
+			fail("%s: %v", window, err)
+		}
+		if cost.Id == "" {
+			continue
+		}
+		if seenIDs[cost.Id] {
+			fail("%s: id %q is used by more than one cost", window, cost.Id)
+		}
+		seenIDs[cost.Id] = true
+	}
+
+	return multiErr
+}
+
+// ValidateCost checks a single cost against the FOCUS rules that don't depend
+// on the rest of the response: it must have an ID and an allowed charge
+// category, quantities and prices must not be negative, and usage or purchases
+// can't be billed above their list cost.
+func ValidateCost(cost *pb.CustomCost) error {
+	var multiErr error
+	fail := func(format string, args ...any) {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("cost %s (%s): "+format, append([]any{cost.Id, cost.ResourceName}, args...)...))
+	}
+
+	if cost.Id == "" {
+		fail("id is empty")
+	}
+	if !ChargeCategories[cost.ChargeCategory] {
+		fail("charge category %q is not one of the FOCUS charge categories", cost.ChargeCategory)
+	}
+	if cost.UsageQuantity < 0 {
+		fail("usage quantity %f is negative", cost.UsageQuantity)
+	}
+	if cost.ListUnitPrice < 0 {
+		fail("list unit price %f is negative", cost.ListUnitPrice)
+	}
+	if cost.ExtendedAttributes != nil && cost.ExtendedAttributes.PricingQuantity != nil && *cost.ExtendedAttributes.PricingQuantity < 0 {
+		fail("pricing quantity %f is negative", *cost.ExtendedAttributes.PricingQuantity)
+	}
+
+	// credits and adjustments are allowed to be negative
+	if cost.ChargeCategory == "Usage" || cost.ChargeCategory == "Purchase" {
+		if cost.BilledCost < 0 {
+			fail("billed cost %f is negative", cost.BilledCost)
+		}
+		if cost.ListCost < 0 {
+			fail("list cost %f is negative", cost.ListCost)
+		}
+		if cost.BilledCost-cost.ListCost > max(centTolerance, relativeTolerance*cost.ListCost) {
+			fail("billed cost %f is greater than list cost %f", cost.BilledCost, cost.ListCost)
+		}
+	}
+
+	return multiErr
+}
@@ -0,0 +1,127 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func validResponse() *pb.CustomCostResponse {
+	start := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	return &pb.CustomCostResponse{
+		Domain:   "test",
+		Currency: "USD",
+		Start:    timestamppb.New(start),
+		End:      timestamppb.New(start.Add(24 * time.Hour)),
+		Costs: []*pb.CustomCost{
+			{Id: "a", ResourceName: "widgets", ChargeCategory: "Usage", BilledCost: 0.9, ListCost: 1, UsageQuantity: 2},
+			{Id: "b", ResourceName: "refund", ChargeCategory: "Credit", BilledCost: -1, ListCost: -1},
+		},
+	}
+}
+
+func TestValidateResponseValid(t *testing.T) {
+	if err := ValidateResponse(validResponse(), "test", 24*time.Hour); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(resp *pb.CustomCostResponse)
+		expected string
+	}{
+		{
+			name:     "errors in response",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Errors = []string{"boom"} },
+			expected: "errors occurred in response",
+		},
+		{
+			name:     "wrong domain",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Domain = "other" },
+			expected: "does not match plugin name",
+		},
+		{
+			name: "wrong window length",
+			modify: func(resp *pb.CustomCostResponse) {
+				resp.End = timestamppb.New(resp.Start.AsTime().Add(time.Hour))
+			},
+			expected: "expected 24h0m0s",
+		},
+		{
+			name: "unaligned window",
+			modify: func(resp *pb.CustomCostResponse) {
+				resp.Start = timestamppb.New(resp.Start.AsTime().Add(time.Hour))
+				resp.End = timestamppb.New(resp.End.AsTime().Add(time.Hour))
+			},
+			expected: "not aligned",
+		},
+		{
+			name:     "bad currency",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Currency = "usd" },
+			expected: "not an ISO 4217 code",
+		},
+		{
+			name:     "bad charge category",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Costs[0].ChargeCategory = "usage" },
+			expected: "not one of the FOCUS charge categories",
+		},
+		{
+			name:     "negative quantity",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Costs[0].UsageQuantity = -1 },
+			expected: "usage quantity -1.000000 is negative",
+		},
+		{
+			name:     "billed above list",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Costs[0].BilledCost = 2 },
+			expected: "greater than list cost",
+		},
+		{
+			name:     "duplicate id",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Costs[1].Id = "a" },
+			expected: `id "a" is used by more than one cost`,
+		},
+		{
+			name:     "missing id",
+			modify:   func(resp *pb.CustomCostResponse) { resp.Costs[1].Id = "" },
+			expected: "id is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := validResponse()
+			tt.modify(resp)
+			err := ValidateResponse(resp, "test", 24*time.Hour)
+			if err == nil {
+				t.Fatalf("expected an error, but got none")
+			}
+			if !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected error to contain %q, got %q", tt.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	data := []byte(`[{"domain": "test", "currency": "USD", "costs": [{"id": "a", "billed_cost": 1.5}]}, {"domain": "test"}]`)
+
+	resps, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resps) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resps))
+	}
+	if resps[0].Domain != "test" || len(resps[0].Costs) != 1 || resps[0].Costs[0].BilledCost != 1.5 {
+		t.Errorf("unexpected response: %v", resps[0])
+	}
+
+	if _, err := Unmarshal([]byte(`{"domain": "test"}`)); err == nil {
+		t.Errorf("expected an error for a non-array, but got none")
+	}
+}
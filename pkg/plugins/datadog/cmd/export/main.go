@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	commonconfig "github.com/opencost/opencost-plugins/common/config"
+	"github.com/opencost/opencost-plugins/common/httpclient"
+	"github.com/opencost/opencost-plugins/common/validation"
+	datadogplugin "github.com/opencost/opencost-plugins/pkg/plugins/datadog/datadogplugin"
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+)
+
+// the export command uploads the costs any plugin reports to OpenCost to
+// Datadog Cloud Cost Management as custom costs, so SaaS spend shows up in
+// both. It reads the responses as the JSON arrays the integration test
+// harness writes, e.g. the output of the openai plugin for a day.
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: export <path-to-datadog-config> <path-to-responses-json>...")
+		os.Exit(1)
+	}
+
+	var ddConfig datadogplugin.DatadogConfig
+	if err := commonconfig.Load(os.Args[1], &ddConfig); err != nil {
+		log.Fatalf("error loading DD config: %v", err)
+	}
+	log.SetLogLevel(ddConfig.DDLogLevel)
+	if ddConfig.Mode != datadogplugin.ModeExport {
+		log.Fatalf("the config must be in %s mode to export costs, got mode %q", datadogplugin.ModeExport, ddConfig.Mode)
+	}
+
+	var resps []*pb.CustomCostResponse
+	for _, path := range os.Args[2:] {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("error reading responses from %s: %v", path, err)
+		}
+		fileResps, err := validation.Unmarshal(data)
+		if err != nil {
+			log.Fatalf("error unmarshalling responses from %s: %v", path, err)
+		}
+		resps = append(resps, fileResps...)
+	}
+
+	costs, err := toCustomCosts(resps)
+	if err != nil {
+		log.Fatalf("error converting responses: %v", err)
+	}
+	if len(costs) == 0 {
+		log.Infof("no costs to export")
+		return
+	}
+	if err := newExporter(ddConfig).export(context.Background(), costs); err != nil {
+		log.Fatalf("error exporting costs: %v", err)
+	}
+}
+
+// customCost is a line item in the FOCUS based format of Datadog's custom
+// costs, as per
+// https://docs.datadoghq.com/cloud_cost_management/setup/custom/
+type customCost struct {
+	ProviderName      string            `json:"ProviderName"`
+	ChargeDescription string            `json:"ChargeDescription"`
+	ChargePeriodStart string            `json:"ChargePeriodStart"`
+	ChargePeriodEnd   string            `json:"ChargePeriodEnd"`
+	BilledCost        float64           `json:"BilledCost"`
+	BillingCurrency   string            `json:"BillingCurrency"`
+	Tags              map[string]string `json:"Tags,omitempty"`
+}
+
+// toCustomCosts converts the costs in resps to custom costs. Datadog's custom
+// costs are daily, so costs of shorter windows are summed by day. Responses
+// with errors may be missing costs, so they are skipped. Responses of a domain
+// whose windows overlap, e.g. from exporting the daily and hourly output of a
+// run together, would count their costs twice, so they are rejected.
+func toCustomCosts(resps []*pb.CustomCostResponse) ([]customCost, error) {
+	byKey := map[string]*customCost{}
+	windows := map[string][]*pb.CustomCostResponse{}
+	for _, resp := range resps {
+		if len(resp.Errors) > 0 {
+			log.Warnf("skipping %s costs starting %s with errors: %v", resp.Domain, resp.Start.AsTime(), resp.Errors)
+			continue
+		}
+		windows[resp.Domain] = append(windows[resp.Domain], resp)
+		day := resp.Start.AsTime().UTC().Truncate(24 * time.Hour)
+		for _, cost := range resp.Costs {
+			item := customCost{
+				ProviderName:      resp.Domain,
+				ChargeDescription: chargeDescription(cost),
+				ChargePeriodStart: day.Format(time.DateOnly),
+				ChargePeriodEnd:   day.AddDate(0, 0, 1).Format(time.DateOnly),
+				BillingCurrency:   resp.Currency,
+				Tags:              costTags(resp, cost),
+			}
+			key := customCostKey(item)
+			if _, found := byKey[key]; !found {
+				byKey[key] = &item
+			}
+			byKey[key].BilledCost += float64(cost.BilledCost)
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	costs := make([]customCost, 0, len(keys))
+	for _, key := range keys {
+		costs = append(costs, *byKey[key])
+	}
+
+	for domain, domainResps := range windows {
+		if err := checkOverlap(domainResps); err != nil {
+			return nil, fmt.Errorf("%s responses %v, export a single resolution of each domain", domain, err)
+		}
+	}
+	return costs, nil
+}
+
+// checkOverlap returns an error if the windows of any two of resps overlap.
+// It sorts resps by the start of their windows.
+func checkOverlap(resps []*pb.CustomCostResponse) error {
+	sort.Slice(resps, func(i, j int) bool {
+		return resps[i].Start.AsTime().Before(resps[j].Start.AsTime())
+	})
+	for i := 1; i < len(resps); i++ {
+		prev, next := resps[i-1], resps[i]
+		if next.Start.AsTime().Before(prev.End.AsTime()) {
+			return fmt.Errorf("overlap: %s-%s and %s-%s", prev.Start.AsTime(), prev.End.AsTime(), next.Start.AsTime(), next.End.AsTime())
+		}
+	}
+	return nil
+}
+
+func chargeDescription(cost *pb.CustomCost) string {
+	if cost.Description != "" && cost.Description != "nil" {
+		return cost.Description
+	}
+	return cost.ResourceName
+}
+
+// costTags returns the labels of cost, along with the fields that tell its
+// costs apart.
+func costTags(resp *pb.CustomCostResponse, cost *pb.CustomCost) map[string]string {
+	tags := map[string]string{}
+	for key, value := range cost.Labels {
+		tags[key] = value
+	}
+	fields := map[string]string{
+		"cost_source":     resp.CostSource,
+		"account_name":    cost.AccountName,
+		"charge_category": cost.ChargeCategory,
+		"resource_name":   cost.ResourceName,
+		"resource_type":   cost.ResourceType,
+		"zone":            cost.Zone,
+	}
+	for key, value := range fields {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// customCostKey identifies the costs summed into a single custom cost.
+func customCostKey(item customCost) string {
+	tags := make([]string, 0, len(item.Tags))
+	for key, value := range item.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	return strings.Join([]string{item.ChargePeriodStart, item.ProviderName, item.ChargeDescription, item.BillingCurrency, strings.Join(tags, ",")}, "|")
+}
+
+// exporter uploads custom costs to Datadog.
+type exporter struct {
+	client *http.Client
+	// baseURL is the Datadog API of the config's site
+	baseURL string
+	apiKey  string
+	appKey  string
+}
+
+func newExporter(ddConfig datadogplugin.DatadogConfig) *exporter {
+	return &exporter{
+		// retries are handled by the http client
+		client:  httpclient.NewClient(httpclient.Config{}),
+		baseURL: "https://api." + ddConfig.DDSite,
+		apiKey:  ddConfig.DDAPIKey,
+		appKey:  ddConfig.DDAppKey,
+	}
+}
+
+// export uploads costs to Datadog as a file per provider and day. Once a
+// provider's costs are uploaded, the files uploaded earlier for that provider
+// with charge periods within the days exported are deleted, so exporting days
+// again replaces their costs rather than adding to them, whatever range they
+// were exported with before.
+func (e *exporter) export(ctx context.Context, costs []customCost) error {
+	// files are listed before uploading, so that only earlier uploads are
+	// replaced
+	earlier, err := e.listFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	byProvider := map[string]map[string][]customCost{}
+	for _, cost := range costs {
+		if byProvider[cost.ProviderName] == nil {
+			byProvider[cost.ProviderName] = map[string][]customCost{}
+		}
+		byProvider[cost.ProviderName][cost.ChargePeriodStart] = append(byProvider[cost.ProviderName][cost.ChargePeriodStart], cost)
+	}
+	providers := make([]string, 0, len(byProvider))
+	for provider := range byProvider {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	for _, provider := range providers {
+		days := make([]string, 0, len(byProvider[provider]))
+		for day := range byProvider[provider] {
+			days = append(days, day)
+		}
+		sort.Strings(days)
+
+		for _, day := range days {
+			name := fmt.Sprintf("opencost-%s-%s.json", provider, day)
+			if err := e.upload(ctx, name, byProvider[provider][day]); err != nil {
+				return err
+			}
+			log.Infof("exported %d custom costs to %s", len(byProvider[provider][day]), name)
+		}
+		if err := e.deleteEarlierUploads(ctx, earlier, provider, days); err != nil {
+			return fmt.Errorf("error replacing earlier uploads of %s costs: %v", provider, err)
+		}
+	}
+	return nil
+}
+
+// customCostsFile is an uploaded custom costs file, as listed by the custom
+// costs API.
+type customCostsFile struct {
+	ID         string `json:"id"`
+	Attributes struct {
+		Name          string   `json:"name"`
+		ProviderNames []string `json:"provider_names"`
+		// ChargePeriod is the range of the file's costs, in milliseconds
+		// since the epoch
+		ChargePeriod struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+		} `json:"charge_period"`
+	} `json:"attributes"`
+}
+
+// upload uploads costs to Datadog's custom costs API as a single file named
+// name.
+func (e *exporter) upload(ctx context.Context, name string, costs []customCost) error {
+	body, err := json.Marshal(costs)
+	if err != nil {
+		return fmt.Errorf("error marshalling custom costs: %v", err)
+	}
+	header := http.Header{}
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if _, err := e.do(ctx, http.MethodPut, "/api/v2/cost/custom_costs", header, body); err != nil {
+		return fmt.Errorf("error uploading custom costs: %v", err)
+	}
+	return nil
+}
+
+// listFiles returns the custom costs files uploaded to Datadog.
+func (e *exporter) listFiles(ctx context.Context) ([]customCostsFile, error) {
+	respBody, err := e.do(ctx, http.MethodGet, "/api/v2/cost/custom_costs", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing custom costs files: %v", err)
+	}
+	var files struct {
+		Data []customCostsFile `json:"data"`
+	}
+	if err := json.Unmarshal(respBody, &files); err != nil {
+		return nil, fmt.Errorf("error decoding custom costs files: %v", err)
+	}
+	return files.Data, nil
+}
+
+// deleteEarlierUploads deletes the files in earlier with only provider's costs
+// and a charge period within days. Files that only partly overlap days are
+// kept, as deleting them would lose the costs of the other days, but logged,
+// as the overlapping days are counted twice until they're exported again.
+func (e *exporter) deleteEarlierUploads(ctx context.Context, earlier []customCostsFile, provider string, days []string) error {
+	exported := map[string]bool{}
+	for _, day := range days {
+		exported[day] = true
+	}
+
+	for _, file := range earlier {
+		if len(file.Attributes.ProviderNames) != 1 || file.Attributes.ProviderNames[0] != provider {
+			continue
+		}
+		start := time.UnixMilli(int64(file.Attributes.ChargePeriod.Start)).UTC().Truncate(24 * time.Hour)
+		end := time.UnixMilli(int64(file.Attributes.ChargePeriod.End)).UTC()
+		if !end.After(start) {
+			end = start.AddDate(0, 0, 1)
+		}
+		covered, overlaps := true, false
+		for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+			if exported[day.Format(time.DateOnly)] {
+				overlaps = true
+			} else {
+				covered = false
+			}
+		}
+		if !overlaps {
+			continue
+		}
+		if !covered {
+			log.Warnf("keeping earlier upload %s (%s) of %s costs, as it covers days that weren't exported", file.ID, file.Attributes.Name, provider)
+			continue
+		}
+		if _, err := e.do(ctx, http.MethodDelete, "/api/v2/cost/custom_costs/"+url.PathEscape(file.ID), nil, nil); err != nil {
+			return fmt.Errorf("error deleting custom costs file %s: %v", file.ID, err)
+		}
+		log.Infof("deleted earlier upload %s (%s) of %s costs", file.ID, file.Attributes.Name, provider)
+	}
+	return nil
+}
+
+// do makes a request to the Datadog API, returning the body of the response.
+// Any response other than a 2xx is returned as an error.
+func (e *exporter) do(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, e.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("DD-API-KEY", e.apiKey)
+	req.Header.Set("DD-APPLICATION-KEY", e.appKey)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, respBody)
+	}
+	return respBody, nil
+}
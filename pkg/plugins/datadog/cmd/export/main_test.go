@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// hourlyResponse returns an openai response for the hour starting at start
+// with a single cost.
+func hourlyResponse(start time.Time, model string, billedCost float32) *pb.CustomCostResponse {
+	return &pb.CustomCostResponse{
+		Metadata:   map[string]string{},
+		CostSource: "inference",
+		Domain:     "openai",
+		Version:    "v1",
+		Currency:   "USD",
+		Start:      timestamppb.New(start),
+		End:        timestamppb.New(start.Add(time.Hour)),
+		Costs: []*pb.CustomCost{{
+			AccountName:    "org",
+			ChargeCategory: "Usage",
+			ResourceName:   model,
+			ResourceType:   "model",
+			Labels:         map[string]string{"project": "web"},
+			BilledCost:     billedCost,
+		}},
+	}
+}
+
+func TestToCustomCosts(t *testing.T) {
+	day := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	failed := hourlyResponse(day.Add(3*time.Hour), "gpt-4o", 100)
+	failed.Errors = []string{"error getting usage"}
+	resps := []*pb.CustomCostResponse{
+		hourlyResponse(day, "gpt-4o", 1),
+		hourlyResponse(day.Add(time.Hour), "gpt-4o", 2),
+		hourlyResponse(day.Add(2*time.Hour), "gpt-4o-mini", 0.5),
+		failed,
+		hourlyResponse(day.Add(24*time.Hour), "gpt-4o", 4),
+	}
+
+	costs, err := toCustomCosts(resps)
+	if err != nil {
+		t.Fatalf("unexpected error converting responses: %v", err)
+	}
+	if len(costs) != 3 {
+		t.Fatalf("expected a cost per model and day, got %v", costs)
+	}
+	byDay := map[string]customCost{}
+	for _, cost := range costs {
+		byDay[cost.ChargePeriodStart+"/"+cost.ChargeDescription] = cost
+	}
+	first := byDay["2024-10-16/gpt-4o"]
+	if first.ProviderName != "openai" || first.ChargeDescription != "gpt-4o" || first.ChargePeriodStart != "2024-10-16" || first.ChargePeriodEnd != "2024-10-17" || first.BillingCurrency != "USD" {
+		t.Errorf("unexpected custom cost %v", first)
+	}
+	if math.Abs(first.BilledCost-3) > 1e-6 {
+		t.Errorf("expected the day's hourly costs to be summed, got %f", first.BilledCost)
+	}
+	if first.Tags["project"] != "web" || first.Tags["account_name"] != "org" || first.Tags["charge_category"] != "Usage" {
+		t.Errorf("expected labels and cost fields in tags, got %v", first.Tags)
+	}
+	if next := byDay["2024-10-17/gpt-4o"]; next.BilledCost != 4 {
+		t.Errorf("expected the next day's cost on its own, got %v", costs)
+	}
+}
+
+func TestToCustomCostsOverlap(t *testing.T) {
+	day := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	daily := hourlyResponse(day, "gpt-4o", 3)
+	daily.End = timestamppb.New(day.AddDate(0, 0, 1))
+	anthropic := hourlyResponse(day, "claude", 1)
+	anthropic.Domain = "anthropic"
+
+	// the hourly and daily output of the same run
+	resps := []*pb.CustomCostResponse{
+		hourlyResponse(day, "gpt-4o", 1),
+		hourlyResponse(day.Add(time.Hour), "gpt-4o", 2),
+		anthropic,
+		daily,
+	}
+	if _, err := toCustomCosts(resps); err == nil {
+		t.Errorf("expected an error for responses with overlapping windows")
+	}
+
+	// the same windows of different domains don't overlap
+	if _, err := toCustomCosts([]*pb.CustomCostResponse{daily, anthropic}); err != nil {
+		t.Errorf("unexpected error for windows of different domains: %v", err)
+	}
+}
+
+// fakeCustomCosts serves Datadog's custom costs API, keeping the uploaded
+// files in memory.
+type fakeCustomCosts struct {
+	t      *testing.T
+	mu     sync.Mutex
+	nextID int
+	files  map[string]uploadedFile
+}
+
+type uploadedFile struct {
+	name  string
+	costs []customCost
+}
+
+func (f *fakeCustomCosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("DD-API-KEY") != "api-key" || r.Header.Get("DD-APPLICATION-KEY") != "app-key" {
+		f.t.Errorf("expected the config's keys, got headers %v", r.Header)
+	}
+
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/api/v2/cost/custom_costs":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+		if err != nil {
+			f.t.Errorf("error parsing file name: %v", err)
+		}
+		var costs []customCost
+		if err := json.NewDecoder(r.Body).Decode(&costs); err != nil {
+			f.t.Errorf("error decoding uploaded costs: %v", err)
+		}
+		f.nextID++
+		id := fmt.Sprintf("file-%d", f.nextID)
+		f.files[id] = uploadedFile{name: params["filename"], costs: costs}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{"data": f.file(id)})
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v2/cost/custom_costs":
+		data := []map[string]any{}
+		for id := range f.files {
+			data = append(data, f.file(id))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v2/cost/custom_costs/"):
+		delete(f.files, strings.TrimPrefix(r.URL.Path, "/api/v2/cost/custom_costs/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+}
+
+// file returns the file with id as the custom costs API describes it, with
+// the providers and charge period of its costs.
+func (f *fakeCustomCosts) file(id string) map[string]any {
+	file := f.files[id]
+	providers := map[string]bool{}
+	var start, end time.Time
+	for _, cost := range file.costs {
+		providers[cost.ProviderName] = true
+		costStart, _ := time.Parse(time.DateOnly, cost.ChargePeriodStart)
+		costEnd, _ := time.Parse(time.DateOnly, cost.ChargePeriodEnd)
+		if start.IsZero() || costStart.Before(start) {
+			start = costStart
+		}
+		if costEnd.After(end) {
+			end = costEnd
+		}
+	}
+	providerNames := []string{}
+	for provider := range providers {
+		providerNames = append(providerNames, provider)
+	}
+	return map[string]any{
+		"id": id,
+		"attributes": map[string]any{
+			"name":           file.name,
+			"provider_names": providerNames,
+			"charge_period":  map[string]any{"start": start.UnixMilli(), "end": end.UnixMilli()},
+		},
+	}
+}
+
+// billedCosts returns the billed costs of the uploaded files by provider and
+// day.
+func (f *fakeCustomCosts) billedCosts() map[string]float64 {
+	billed := map[string]float64{}
+	for _, file := range f.files {
+		for _, cost := range file.costs {
+			billed[cost.ProviderName+"/"+cost.ChargePeriodStart] += cost.BilledCost
+		}
+	}
+	return billed
+}
+
+func TestExport(t *testing.T) {
+	fake := &fakeCustomCosts{t: t, files: map[string]uploadedFile{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	e := &exporter{client: srv.Client(), baseURL: srv.URL, apiKey: "api-key", appKey: "app-key"}
+	costs := []customCost{{
+		ProviderName:      "openai",
+		ChargeDescription: "gpt-4o",
+		ChargePeriodStart: "2024-10-16",
+		ChargePeriodEnd:   "2024-10-17",
+		BilledCost:        3,
+		BillingCurrency:   "USD",
+	}}
+	// exporting the same range again replaces the earlier upload
+	for i := 0; i < 2; i++ {
+		if err := e.export(context.Background(), costs); err != nil {
+			t.Fatalf("unexpected error exporting: %v", err)
+		}
+	}
+	if len(fake.files) != 1 {
+		t.Fatalf("expected a single uploaded file, got %v", fake.files)
+	}
+	for _, file := range fake.files {
+		if file.name != "opencost-openai-2024-10-16.json" {
+			t.Errorf("unexpected file name %q", file.name)
+		}
+		if !reflect.DeepEqual(file.costs, costs) {
+			t.Errorf("expected costs to be uploaded as they are, got %v", file.costs)
+		}
+	}
+
+	// an overlapping range replaces the days it covers, and another provider's
+	// costs are kept
+	other := costs[0]
+	other.ProviderName = "anthropic"
+	if err := e.export(context.Background(), []customCost{other}); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+	next := costs[0]
+	next.ChargePeriodStart, next.ChargePeriodEnd = "2024-10-17", "2024-10-18"
+	if err := e.export(context.Background(), []customCost{costs[0], next}); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+	expected := map[string]float64{"openai/2024-10-16": 3, "openai/2024-10-17": 3, "anthropic/2024-10-16": 3}
+	if billed := fake.billedCosts(); !reflect.DeepEqual(billed, expected) {
+		t.Errorf("expected each day's costs once, got %v", billed)
+	}
+	if len(fake.files) != 3 {
+		t.Errorf("expected a file per provider and day, got %v", fake.files)
+	}
+
+	// an earlier upload spanning days that aren't exported again is kept
+	fake.files["multi-day"] = uploadedFile{name: "opencost-openai-2024-10-15-2024-10-17.json", costs: []customCost{
+		{ProviderName: "openai", ChargePeriodStart: "2024-10-15", ChargePeriodEnd: "2024-10-16", BilledCost: 1},
+		{ProviderName: "openai", ChargePeriodStart: "2024-10-16", ChargePeriodEnd: "2024-10-17", BilledCost: 1},
+	}}
+	if err := e.export(context.Background(), costs); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+	if _, found := fake.files["multi-day"]; !found {
+		t.Errorf("expected a partly overlapping upload to be kept")
+	}
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errors":["invalid file"]}`, http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	e.baseURL = rejecting.URL
+	if err := e.export(context.Background(), costs); err == nil {
+		t.Errorf("expected an error when datadog rejects the costs")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV1"
+	datadogplugin "github.com/opencost/opencost-plugins/pkg/plugins/datadog/datadogplugin"
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"google.golang.org/protobuf/proto"
+)
+
+// tagUsage is the usage Datadog attributes to one combination of tag values.
+type tagUsage struct {
+	// key identifies the combination of tag values, e.g. "team=web,service=api"
+	key    string
+	labels map[string]string
+	usage  float64
+}
+
+// attributeCosts splits each cost whose usage type can be attributed to tags
+// into a cost per combination of the attribution tags' values, in proportion
+// to the usage Datadog attributes to each in window. The tag values are added
+// to the labels of the costs. Costs without attributed usage are left whole.
+func (d *DatadogCostSource) attributeCosts(ctx context.Context, org *ddOrg, window opencost.Window, costs []*pb.CustomCost, usageMappings map[string]datadogplugin.UsageTypeMapping) ([]*pb.CustomCost, error) {
+	// usage by attribution usage type, then by org public ID
+	attributions := map[string]map[string][]*tagUsage{}
+	attributed := make([]*pb.CustomCost, 0, len(costs))
+	for _, cost := range costs {
+		usageType := usageMappings[cost.ProviderId].AttributionUsageType
+		if usageType == "" {
+			attributed = append(attributed, cost)
+			continue
+		}
+
+		if _, found := attributions[usageType]; !found {
+			byOrg, err := d.getUsageAttribution(ctx, org, window, usageType)
+			if err != nil {
+				return nil, err
+			}
+			attributions[usageType] = byOrg
+		}
+
+		// org names aren't unique, so usage is matched by public ID
+		byTags := attributions[usageType][cost.ExtendedAttributes.GetSubAccountId()]
+		total := 0.0
+		for _, tags := range byTags {
+			total += tags.usage
+		}
+		if total == 0 {
+			log.Debugf("no usage attributed to tags for %s in org %s", cost.ResourceName, cost.AccountName)
+			attributed = append(attributed, cost)
+			continue
+		}
+
+		for _, tags := range byTags {
+			attributed = append(attributed, splitCost(cost, tags, tags.usage/total))
+		}
+	}
+	return attributed, nil
+}
+
+// splitCost returns the share of cost attributed to tags.
+func splitCost(cost *pb.CustomCost, tags *tagUsage, share float64) *pb.CustomCost {
+	split := proto.Clone(cost).(*pb.CustomCost)
+	split.Id = cost.Id + "/" + tags.key
+	if split.Labels == nil {
+		split.Labels = map[string]string{}
+	}
+	for key, value := range tags.labels {
+		split.Labels[key] = value
+	}
+
+	split.UsageQuantity = float32(float64(cost.UsageQuantity) * share)
+	split.BilledCost = float32(float64(cost.BilledCost) * share)
+	split.ListCost = float32(float64(cost.ListCost) * share)
+	if split.ExtendedAttributes != nil && split.ExtendedAttributes.PricingQuantity != nil {
+		pricingQuantity := float32(float64(*cost.ExtendedAttributes.PricingQuantity) * share)
+		split.ExtendedAttributes.PricingQuantity = &pricingQuantity
+	}
+	return split
+}
+
+// getUsageAttribution returns the usage of usageType by org in window, and by
+// its child orgs if enabled, by org public ID, broken down by the attribution
+// tags. The usage of each day is fetched once and shared by all its windows.
+func (d *DatadogCostSource) getUsageAttribution(ctx context.Context, org *ddOrg, window opencost.Window, usageType string) (map[string][]*tagUsage, error) {
+	byOrg := map[string]map[string]*tagUsage{}
+	for day := window.Start().UTC().Truncate(24 * time.Hour); day.Before(*window.End()); day = day.Add(24 * time.Hour) {
+		// usage is only attributed up to the current hour
+		end := day.Add(24 * time.Hour)
+		if currentHourEnd := time.Now().UTC().Truncate(time.Hour).Add(time.Hour); currentHourEnd.Before(end) {
+			end = currentHourEnd
+		}
+		needed := *window.End()
+		if end.Before(needed) {
+			needed = end
+		}
+		records, err := org.attributions.get(ctx, attributionKey{usageType: usageType, day: day}, end, needed, func() ([]attributedUsage, error) {
+			return d.getHourlyUsageAttribution(ctx, org, day, end, usageType)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.hour.Before(*window.Start()) || !record.hour.Before(*window.End()) {
+				continue
+			}
+			if _, found := byOrg[record.publicId]; !found {
+				byOrg[record.publicId] = map[string]*tagUsage{}
+			}
+			if _, found := byOrg[record.publicId][record.key]; !found {
+				byOrg[record.publicId][record.key] = &tagUsage{key: record.key, labels: record.labels}
+			}
+			byOrg[record.publicId][record.key].usage += record.usage
+		}
+	}
+
+	// costs are split in the order of the tag values, so responses are the
+	// same every time
+	result := map[string][]*tagUsage{}
+	for publicId, byTags := range byOrg {
+		for _, tags := range byTags {
+			result[publicId] = append(result[publicId], tags)
+		}
+		sort.Slice(result[publicId], func(i, j int) bool {
+			return result[publicId][i].key < result[publicId][j].key
+		})
+	}
+	return result, nil
+}
+
+// attributedUsage is the usage Datadog attributes to one combination of tag
+// values in one org and hour.
+type attributedUsage struct {
+	publicId string
+	hour     time.Time
+	key      string
+	labels   map[string]string
+	usage    float64
+}
+
+// getHourlyUsageAttribution returns the usage of usageType attributed to the
+// attribution tags by org from the start of day until end.
+func (d *DatadogCostSource) getHourlyUsageAttribution(ctx context.Context, org *ddOrg, day, end time.Time, usageType string) ([]attributedUsage, error) {
+	ddCtx := org.ddContext(ctx)
+	tagBreakdownKeys := strings.Join(d.attributionTags, ",")
+
+	var records []attributedUsage
+	var nextRecordId *string
+	for {
+		// rate limiting and retries are handled by the http client the API was built with
+		params := datadogV1.GetHourlyUsageAttributionOptionalParameters{
+			EndHr:              &end,
+			TagBreakdownKeys:   &tagBreakdownKeys,
+			NextRecordId:       nextRecordId,
+			IncludeDescendants: &org.includeChildOrgs,
+		}
+		resp, _, err := org.v1UsageApi.GetHourlyUsageAttribution(ddCtx, day, datadogV1.HourlyUsageAttributionUsageType(usageType), params)
+		if err != nil {
+			return nil, fmt.Errorf("error getting hourly usage attribution for %s: %v", usageType, err)
+		}
+
+		for _, body := range resp.Usage {
+			if body.PublicId == nil || body.Hour == nil || body.TotalUsageSum == nil {
+				continue
+			}
+			labels, key := d.attributionLabels(body.Tags)
+			records = append(records, attributedUsage{
+				publicId: *body.PublicId,
+				hour:     body.Hour.UTC(),
+				key:      key,
+				labels:   labels,
+				usage:    *body.TotalUsageSum,
+			})
+		}
+
+		if resp.Metadata == nil || resp.Metadata.Pagination == nil || !resp.Metadata.Pagination.NextRecordId.IsSet() || resp.Metadata.Pagination.NextRecordId.Get() == nil {
+			break
+		}
+		nextRecordId = resp.Metadata.Pagination.NextRecordId.Get()
+	}
+	return records, nil
+}
+
+// attributionLabels returns the labels for the attribution tags in tags, and
+// a key identifying their values. Tags with more than one value have their
+// values joined with "|".
+func (d *DatadogCostSource) attributionLabels(tags map[string][]string) (map[string]string, string) {
+	labels := map[string]string{}
+	var keyParts []string
+	for _, tag := range d.attributionTags {
+		values := tags[tag]
+		if len(values) == 0 {
+			continue
+		}
+		labels[tag] = strings.Join(values, "|")
+		keyParts = append(keyParts, tag+"="+labels[tag])
+	}
+	if len(keyParts) == 0 {
+		return labels, "untagged"
+	}
+	return labels, strings.Join(keyParts, ",")
+}
+
+// attributionCache holds the attributed usage of each usage type and day for
+// ttl, so the windows of a day share one set of attribution calls, and calls
+// made at the same time for a day wait for the same fetch.
+type attributionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[attributionKey]*attributionEntry
+}
+
+type attributionKey struct {
+	usageType string
+	day       time.Time
+}
+
+type attributionEntry struct {
+	// ready is closed once records, err and fetched are set
+	ready   chan struct{}
+	records []attributedUsage
+	err     error
+	fetched time.Time
+	// end is when the fetched usage ends
+	end time.Time
+}
+
+func newAttributionCache(ttl time.Duration) *attributionCache {
+	return &attributionCache{
+		ttl:     ttl,
+		entries: map[attributionKey]*attributionEntry{},
+	}
+}
+
+// get returns the attributed usage for key, calling fetch for the usage until
+// end if it isn't cached, has expired, or ends before needed. Errors aren't
+// cached.
+func (c *attributionCache) get(ctx context.Context, key attributionKey, end, needed time.Time, fetch func() ([]attributedUsage, error)) ([]attributedUsage, error) {
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	if found {
+		select {
+		case <-entry.ready:
+			if time.Since(entry.fetched) >= c.ttl || entry.end.Before(needed) {
+				found = false
+			}
+		default:
+			// another window is fetching the usage
+		}
+	}
+	if !found {
+		c.evictExpired()
+		entry = &attributionEntry{ready: make(chan struct{}), end: end}
+		c.entries[key] = entry
+		c.mu.Unlock()
+
+		entry.records, entry.err = fetch()
+		entry.fetched = time.Now()
+		if entry.err != nil {
+			c.mu.Lock()
+			if c.entries[key] == entry {
+				delete(c.entries, key)
+			}
+			c.mu.Unlock()
+		}
+		close(entry.ready)
+		return entry.records, entry.err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		log.Debugf("using cached %s attribution for %s", key.usageType, key.day.Format("2006-01-02"))
+		return entry.records, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// evictExpired drops the entries that have expired, so usage of days that
+// are no longer requested doesn't pile up. c.mu must be held.
+func (c *attributionCache) evictExpired() {
+	for key, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if time.Since(entry.fetched) >= c.ttl {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
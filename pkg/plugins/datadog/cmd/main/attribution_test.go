@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAttributionCache(t *testing.T) {
+	day := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	key := attributionKey{usageType: "infra_host_usage", day: day}
+	fetches := 0
+	fetch := func() ([]attributedUsage, error) {
+		fetches++
+		return []attributedUsage{{publicId: "public", hour: day, key: "team=web", usage: 1}}, nil
+	}
+
+	t.Run("shared until more usage is needed", func(t *testing.T) {
+		fetches = 0
+		c := newAttributionCache(time.Hour)
+		for _, needed := range []time.Time{day.Add(time.Hour), day.Add(2 * time.Hour)} {
+			if _, err := c.get(context.Background(), key, day.Add(2*time.Hour), needed, fetch); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if fetches != 1 {
+			t.Errorf("expected windows within the fetched usage to share it, got %d fetches", fetches)
+		}
+		if _, err := c.get(context.Background(), key, day.Add(3*time.Hour), day.Add(3*time.Hour), fetch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fetches != 2 {
+			t.Errorf("expected usage after the fetched usage to be fetched, got %d fetches", fetches)
+		}
+	})
+
+	t.Run("expired entries are evicted", func(t *testing.T) {
+		fetches = 0
+		c := newAttributionCache(0)
+		for i := 0; i < 3; i++ {
+			other := attributionKey{usageType: "infra_host_usage", day: day.AddDate(0, 0, i)}
+			if _, err := c.get(context.Background(), other, day, day, fetch); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if fetches != 3 || len(c.entries) != 1 {
+			t.Errorf("expected only the latest entry to be kept, got %d entries after %d fetches", len(c.entries), fetches)
+		}
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		c := newAttributionCache(time.Hour)
+		_, err := c.get(context.Background(), key, day, day, func() ([]attributedUsage, error) {
+			return nil, fmt.Errorf("boom")
+		})
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		records, err := c.get(context.Background(), key, day, day, fetch)
+		if err != nil || len(records) != 1 {
+			t.Errorf("expected the usage to be fetched again, got %v, error %v", records, err)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/opencost"
+)
+
+// hoursPerMonth is how many hours Datadog bills a month of monthly usage,
+// such as a host, as
+const hoursPerMonth = 730
+
+// monthlyCharge is the usage of a billing dimension Datadog bills for a month
+// as a whole, such as the 99th percentile of hosts, rather than per unit.
+// Windows are billed the share of it their usage makes up of the month's, so
+// the costs of every window in the month add up to it.
+type monthlyCharge struct {
+	// billable are the units of usage billed for the month so far, e.g. the
+	// billed hosts for 730 hours prorated to the share of the month so far
+	billable float64
+	// used are the units of usage in the month so far, e.g. host-hours
+	used float64
+	// monthShare is the share of the month so far
+	monthShare float64
+}
+
+// coverMonthlyCharges returns prices with monthly charges that include the
+// usage in window. Each window is billed the share of the charges its usage
+// makes up, so windows ending after the usage the charges were computed from
+// would be billed shares that add up to more than the charges. Their charges
+// are computed again, and replace the cached ones.
+func (d *DatadogCostSource) coverMonthlyCharges(ctx context.Context, org *ddOrg, prices *monthUnitPrices, window opencost.Window) (*monthUnitPrices, error) {
+	windowStart := window.Start().UTC()
+	inPricingMonth := prices.month.Equal(time.Date(windowStart.Year(), windowStart.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if !inPricingMonth || !window.End().After(prices.chargesEnd) {
+		return prices, nil
+	}
+
+	updated := *prices
+	var err error
+	updated.monthlyCharges, updated.chargesEnd, err = d.getMonthlyCharges(ctx, org, prices)
+	if err != nil {
+		return nil, err
+	}
+	org.unitPrices.replace(prices.month, prices, &updated)
+	return &updated, nil
+}
+
+// getMonthlyCharges returns the monthly charges of org's billing dimensions
+// that are billed monthly, from their hourly usage in the month of prices so
+// far, including the current hour, and when the usage they're computed from
+// ends.
+func (d *DatadogCostSource) getMonthlyCharges(ctx context.Context, org *ddOrg, prices *monthUnitPrices) (map[string]monthlyCharge, time.Time, error) {
+	monthEnd := prices.month.AddDate(0, 1, 0)
+	end := monthEnd
+	if currentHourEnd := time.Now().UTC().Truncate(time.Hour).Add(time.Hour); currentHourEnd.Before(end) {
+		end = currentHourEnd
+	}
+	if !end.After(prices.month) {
+		return nil, end, nil
+	}
+
+	// only the product families with the usage of monthly billed dimensions
+	// the usage filter lets through are queried
+	families := map[string]bool{}
+	queryAll := false
+	for _, price := range d.listPrices.Prices {
+		if !price.BilledMonthly() {
+			continue
+		}
+		if price.ProductFamily == "" {
+			queryAll = true
+			continue
+		}
+		if d.usageFilter.IncludesProductFamily(price.ProductFamily) {
+			families[price.ProductFamily] = true
+		}
+	}
+	productFamilies := joinSorted(families)
+	if queryAll {
+		productFamilies = d.usageFilter.ProductFamilies()
+	}
+	if productFamilies == "" {
+		// nothing is billed monthly, however much usage there is
+		return nil, monthEnd, nil
+	}
+
+	window := opencost.NewWindow(&prices.month, &end)
+	records, errs := d.getHourlyUsage(ctx, org, window, productFamilies)
+	if len(errs) > 0 {
+		return nil, end, fmt.Errorf("error getting hourly usage of %s so far: %s", prices.month.Format("2006-01"), strings.Join(errs, "; "))
+	}
+
+	// usage of each monthly billed dimension by hour of the month, including
+	// hours without usage
+	hours := int(end.Sub(prices.month).Hours())
+	hourly := map[string][]float64{}
+	for _, record := range records {
+		attrs := record.Attributes
+		if attrs == nil || attrs.Timestamp == nil || attrs.ProductFamily == nil {
+			continue
+		}
+		hour := int(attrs.Timestamp.Sub(prices.month).Hours())
+		if hour < 0 || hour >= hours {
+			continue
+		}
+		for _, measurement := range attrs.Measurements {
+			if measurement.UsageType == nil || !measurement.Value.IsSet() {
+				continue
+			}
+			if !d.usageFilter.Includes(*attrs.ProductFamily, *measurement.UsageType) {
+				continue
+			}
+			_, usageMapping, found := d.usageMapping.Lookup(*attrs.ProductFamily, *measurement.UsageType)
+			if !found || !d.listPrices.Prices[usageMapping.BillingDimension].BilledMonthly() {
+				continue
+			}
+			if hourly[usageMapping.BillingDimension] == nil {
+				hourly[usageMapping.BillingDimension] = make([]float64, hours)
+			}
+			hourly[usageMapping.BillingDimension][hour] += float64(measurement.GetValue())
+		}
+	}
+
+	monthShare := end.Sub(prices.month).Hours() / monthEnd.Sub(prices.month).Hours()
+	charges := map[string]monthlyCharge{}
+	for billingDimension, usage := range hourly {
+		used := 0.0
+		for _, quantity := range usage {
+			used += quantity
+		}
+		if used == 0 {
+			continue
+		}
+		quantity := d.listPrices.Prices[billingDimension].MonthlyQuantity(usage)
+		charges[billingDimension] = monthlyCharge{
+			billable:   quantity * hoursPerMonth * monthShare,
+			used:       used,
+			monthShare: monthShare,
+		}
+		log.Debugf("%s of %s billed for %f of %f units so far", billingDimension, prices.month.Format("2006-01"), quantity*hoursPerMonth*monthShare, used)
+	}
+	return charges, end, nil
+}
@@ -2,89 +2,159 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	_nethttp "net/http"
-	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadog"
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
-	"github.com/agnivade/levenshtein"
 	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV1"
-	"github.com/hashicorp/go-plugin"
-	commonconfig "github.com/opencost/opencost-plugins/pkg/common/config"
+	"github.com/opencost/opencost-plugins/common/cache"
+	commonconfig "github.com/opencost/opencost-plugins/common/config"
+	"github.com/opencost/opencost-plugins/common/httpclient"
+	"github.com/opencost/opencost-plugins/common/sdk"
 	datadogplugin "github.com/opencost/opencost-plugins/pkg/plugins/datadog/datadogplugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
 	"github.com/opencost/opencost/core/pkg/opencost"
-	ocplugin "github.com/opencost/opencost/core/pkg/plugin"
 )
 
 // URL of the Datadog pricing page
 const url = "https://aws.amazon.com/marketplace/pp/prodview-536p4hpqbajc2"
 
-// handshakeConfigs are used to just do a basic handshake between
-// a plugin and host. If the handshake fails, a user friendly error is shown.
-// This prevents users from executing bad plugins or executing a plugin
-// directory. It is a UX feature, not a security feature.
-var handshakeConfig = plugin.HandshakeConfig{
-	ProtocolVersion:  1,
-	MagicCookieKey:   "PLUGIN_NAME",
-	MagicCookieValue: "datadog",
-}
-
 // Implementation of CustomCostSource
 type DatadogCostSource struct {
-	ddCtx       context.Context
-	usageApi    *datadogV2.UsageMeteringApi
-	v1UsageApi  *datadogV1.UsageMeteringApi
+	// orgs are the Datadog orgs costs are fetched from
+	orgs        []*ddOrg
 	rateLimiter *rate.Limiter
+	// costSource fetches the windows of each request with the cache, timeout
+	// and parallelism in the config
+	costSource *sdk.CostSource
+	// usageMapping maps usage types to the billing dimensions they're priced by
+	usageMapping *datadogplugin.UsageMapping
+	// rateCard is the contract price of each billing dimension
+	rateCard map[string]datadogplugin.ContractRate
+	// listPrices are the public prices of each billing dimension
+	listPrices *datadogplugin.ListPrices
+	// allotments are the usage included with other usage
+	allotments *datadogplugin.Allotments
+	// attributionTags are the tag keys costs are split by, if any
+	attributionTags []string
+	// usageFilter limits the usage that is fetched and priced
+	usageFilter datadogplugin.UsageFilter
+	// reconciliation is how costs are corrected to match Datadog's, if at all
+	reconciliation string
+}
+
+// ddOrg is a Datadog org, and the clients to fetch its usage and costs with.
+type ddOrg struct {
+	// name identifies the org in errors and logs
+	name       string
+	ddCtx      context.Context
+	usageApi   *datadogV2.UsageMeteringApi
+	v1UsageApi *datadogV1.UsageMeteringApi
+	// includeChildOrgs is set when usage of the org's child orgs is fetched too
+	includeChildOrgs bool
+	// unitPrices caches the prices derived from estimated costs per month
+	unitPrices *unitPriceCache
+	// attributions caches the usage attributed to tags per usage type and day
+	attributions *attributionCache
 }
 
 func (d *DatadogCostSource) GetCustomCosts(req *pb.CustomCostRequest) []*pb.CustomCostResponse {
-	results := []*pb.CustomCostResponse{}
+	src := *d.costSource
+	src.Fetch = d.getCostsForWindow
+	return src.GetCustomCosts(req)
+}
 
-	targets, err := opencost.GetWindows(req.Start.AsTime(), req.End.AsTime(), req.Resolution.AsDuration())
-	if err != nil {
-		log.Errorf("error getting windows: %v", err)
-		errResp := pb.CustomCostResponse{
-			Errors: []string{fmt.Sprintf("error getting windows: %v", err)},
+func (d *DatadogCostSource) getCostsForWindow(ctx context.Context, target opencost.Window) (*pb.CustomCostResponse, error) {
+	var resps []*pb.CustomCostResponse
+	var errs []string
+	for _, org := range d.orgs {
+		resp, err := d.getOrgCostsForWindow(ctx, org, target)
+		if err != nil {
+			// the other orgs' costs are still returned, but with the error, so
+			// they aren't cached
+			log.Errorf("error getting costs of %s: %v", org.name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", org.name, err))
+			continue
 		}
-		results = append(results, &errResp)
-		return results
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
 	}
 
-	for _, target := range targets {
-		// Call the function to scrape prices
-		unitPricing, err := d.GetDDUnitPrices(target.Start().UTC())
-		if err != nil {
-			log.Errorf("error getting dd pricing: %v", err)
-			errResp := pb.CustomCostResponse{
-				Errors: []string{fmt.Sprintf("error getting dd pricing: %v", err)},
+	resp := mergeResponses(resps)
+	resp.Errors = append(resp.Errors, errs...)
+	return resp, nil
+}
+
+// getOrgCostsForWindow returns the costs of org, and its child orgs if
+// enabled, in target.
+func (d *DatadogCostSource) getOrgCostsForWindow(ctx context.Context, org *ddOrg, target opencost.Window) (*pb.CustomCostResponse, error) {
+	// Call the function to scrape prices
+	unitPricing, err := d.GetDDUnitPrices(ctx, org, target.Start().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error getting dd pricing: %v", err)
+	}
+	unitPricing, err = d.coverMonthlyCharges(ctx, org, unitPricing, target)
+	if err != nil {
+		return nil, fmt.Errorf("error getting monthly charges: %v", err)
+	}
+	log.Debugf("got unit pricing of %s for %s: %v", org.name, unitPricing.month.Format("2006-01"), unitPricing.costs)
+
+	resp := d.getDDCostsForWindow(ctx, org, target, unitPricing)
+	resp.Metadata["pricing_month"] = unitPricing.month.Format("2006-01")
+	// windows of a month without costs yet are priced with an earlier month,
+	// so they will be restated even when that month's prices are final
+	resp.Metadata[cache.StatusMetadataKey] = cache.StatusEstimated
+	windowMonth := time.Date(target.Start().UTC().Year(), target.Start().UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	if unitPricing.final && unitPricing.month.Equal(windowMonth) {
+		resp.Metadata[cache.StatusMetadataKey] = cache.StatusFinal
+	}
+	return resp, nil
+}
+
+// mergeResponses combines the responses of several orgs for the same window
+// into the first. Metadata values that differ between them are joined, and
+// the costs are only final once every org's are.
+func mergeResponses(resps []*pb.CustomCostResponse) *pb.CustomCostResponse {
+	merged := resps[0]
+	for _, resp := range resps[1:] {
+		merged.Costs = append(merged.Costs, resp.Costs...)
+		merged.Errors = append(merged.Errors, resp.Errors...)
+		for key, value := range resp.Metadata {
+			if key == cache.StatusMetadataKey {
+				if value == cache.StatusEstimated {
+					merged.Metadata[key] = value
+				}
+				continue
 			}
-			results = append(results, &errResp)
-			return results
-		} else {
-			log.Debugf("got unit pricing: %v", unitPricing)
-		}
-		// DataDog gets mad if we ask them to tell the future
-		if target.Start().After(time.Now().UTC()) {
-			log.Debugf("skipping future window %v", target)
-			continue
+			values := map[string]bool{}
+			for _, v := range strings.Split(merged.Metadata[key], ",") {
+				values[v] = true
+			}
+			for _, v := range strings.Split(value, ",") {
+				values[v] = true
+			}
+			delete(values, "")
+			merged.Metadata[key] = joinSorted(values)
 		}
-
-		log.Debugf("fetching DD costs for window %v", target)
-		result := d.getDDCostsForWindow(target, unitPricing)
-		results = append(results, result)
 	}
+	return merged
+}
 
-	return results
+// ddContext returns a context with the deadline of ctx that carries the
+// datadog site and API keys the org's clients were built with.
+func (o *ddOrg) ddContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, datadog.ContextServerVariables, o.ddCtx.Value(datadog.ContextServerVariables))
+	return context.WithValue(ctx, datadog.ContextAPIKeys, o.ddCtx.Value(datadog.ContextAPIKeys))
 }
 
 func main() {
@@ -94,28 +164,98 @@ func main() {
 		log.Fatalf("error opening config file: %v", err)
 	}
 
-	ddConfig, err := getDatadogConfig(configFile)
+	// datadog usage APIs allow 10 requests every 30 seconds. The limiter
+	// outlives config reloads, so rotating keys doesn't reset it.
+	rateLimiter := rate.NewLimiter(0.1, 1)
+	var ddCostSrc sdk.SwappableSource
+	_, err = commonconfig.Watch(configFile, commonconfig.DefaultWatchInterval, func(ddConfig *datadogplugin.DatadogConfig) error {
+		src, err := newDatadogCostSource(ddConfig, rateLimiter)
+		if err != nil {
+			return err
+		}
+		if err := sdk.StartTelemetry("datadog", ddConfig.Config); err != nil {
+			return err
+		}
+		log.SetLogLevel(ddConfig.DDLogLevel)
+		ddCostSrc.Store(src)
+		return nil
+	})
 	if err != nil {
 		log.Fatalf("error building DD config: %v", err)
 	}
-	log.SetLogLevel(ddConfig.DDLogLevel)
-	// datadog usage APIs allow 10 requests every 30 seconds
-	rateLimiter := rate.NewLimiter(0.1, 1)
-	ddCostSrc := DatadogCostSource{
-		rateLimiter: rateLimiter,
-	}
-	ddCostSrc.ddCtx, ddCostSrc.usageApi, ddCostSrc.v1UsageApi = getDatadogClients(*ddConfig)
 
-	// pluginMap is the map of plugins we can dispense.
-	var pluginMap = map[string]plugin.Plugin{
-		"CustomCostSource": &ocplugin.CustomCostPlugin{Impl: &ddCostSrc},
+	sdk.Serve("datadog", &ddCostSrc)
+}
+
+// newDatadogCostSource builds a cost source with the credentials and settings
+// in ddConfig. A new one is built every time the config is reloaded.
+func newDatadogCostSource(ddConfig *datadogplugin.DatadogConfig, rateLimiter *rate.Limiter) (*DatadogCostSource, error) {
+	switch ddConfig.Mode {
+	case "", datadogplugin.ModeImport:
+	case datadogplugin.ModeExport:
+		return nil, fmt.Errorf("the config is in export mode, which the export command uploads costs to datadog with")
+	default:
+		return nil, fmt.Errorf("unknown mode %q", ddConfig.Mode)
+	}
+	// DD estimated costs can be delayed 72 hours, so windows are only final after that
+	costSource, err := sdk.NewCostSource("datadog", ddConfig.Config, 72*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	usageMapping, err := datadogplugin.LoadUsageMapping(ddConfig.UsageMapping)
+	if err != nil {
+		return nil, err
+	}
+	listPrices, err := datadogplugin.LoadListPrices(ddConfig.ListPrices)
+	if err != nil {
+		return nil, err
+	}
+	allotments, err := datadogplugin.LoadAllotments(ddConfig.Allotments)
+	if err != nil {
+		return nil, err
+	}
+	if err := ddConfig.UsageFilter.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating usage filter: %v", err)
+	}
+	switch ddConfig.Reconciliation {
+	case "", datadogplugin.ReconciliationTrueUp, datadogplugin.ReconciliationAdjustment:
+	default:
+		return nil, fmt.Errorf("unknown reconciliation %q", ddConfig.Reconciliation)
+	}
+	// estimated costs are only updated about once a day
+	unitPriceTTL := 6 * time.Hour
+	if ddConfig.UnitPriceTTL != "" {
+		unitPriceTTL, err = time.ParseDuration(ddConfig.UnitPriceTTL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing unit price TTL: %v", err)
+		}
+	}
+	ddCostSrc := DatadogCostSource{
+		rateLimiter:     rateLimiter,
+		costSource:      costSource,
+		usageMapping:    usageMapping,
+		rateCard:        ddConfig.RateCard,
+		listPrices:      listPrices,
+		allotments:      allotments,
+		attributionTags: ddConfig.AttributionTags,
+		usageFilter:     ddConfig.UsageFilter,
+		reconciliation:  ddConfig.Reconciliation,
+	}
+	for i, orgConfig := range ddConfig.AllOrgs() {
+		if orgConfig.DDSite == "" || orgConfig.DDAPIKey == "" || orgConfig.DDAppKey == "" {
+			return nil, fmt.Errorf("org %d is missing its datadog site or keys", i)
+		}
+		org := &ddOrg{
+			name:             fmt.Sprintf("org %d (%s)", i, orgConfig.DDSite),
+			includeChildOrgs: orgConfig.IncludeChildOrgs,
+			unitPrices:       newUnitPriceCache(unitPriceTTL),
+			attributions:     newAttributionCache(unitPriceTTL),
+		}
+		org.ddCtx, org.usageApi, org.v1UsageApi = getDatadogClients(orgConfig, rateLimiter)
+		ddCostSrc.orgs = append(ddCostSrc.orgs, org)
 	}
 
-	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: handshakeConfig,
-		Plugins:         pluginMap,
-		GRPCServer:      plugin.DefaultGRPCServer,
-	})
+	return &ddCostSrc, nil
 }
 
 func boilerplateDDCustomCost(win opencost.Window) pb.CustomCostResponse {
@@ -131,113 +271,117 @@ func boilerplateDDCustomCost(win opencost.Window) pb.CustomCostResponse {
 		Costs:      []*pb.CustomCost{},
 	}
 }
-func (d *DatadogCostSource) getDDCostsForWindow(window opencost.Window, listPricing map[string]billableCost) *pb.CustomCostResponse {
-	ccResp := boilerplateDDCustomCost(window)
-	costs := map[string]*pb.CustomCost{}
-	nextPageId := "init"
-	for morepages := true; morepages; morepages = (nextPageId != "") {
-		params := datadogV2.NewGetHourlyUsageOptionalParameters()
-		if nextPageId != "init" {
-			params.PageNextRecordId = &nextPageId
-		}
 
-		if d.rateLimiter.Tokens() < 1.0 {
-			log.Infof("datadog rate limit reached. holding request until rate capacity is back")
-		}
+// getDDCostsForWindow returns the costs of org's usage in window, priced with
+// unitPricing. Each org's costs carry its public ID as their sub account ID,
+// and the ID of the org billed for them as their account ID.
+func (d *DatadogCostSource) getDDCostsForWindow(ctx context.Context, org *ddOrg, window opencost.Window, unitPricing *monthUnitPrices) *pb.CustomCostResponse {
+	ccResp, usageMappings := d.getPricedCosts(ctx, org, window, unitPricing)
 
-		err := d.rateLimiter.WaitN(context.TODO(), 1)
+	if len(d.attributionTags) > 0 {
+		attributed, err := d.attributeCosts(ctx, org, window, ccResp.Costs, usageMappings)
 		if err != nil {
-			log.Errorf("error waiting on rate limiter`: %v\n", err)
+			log.Errorf("error attributing costs to tags: %v", err)
 			ccResp.Errors = append(ccResp.Errors, err.Error())
-			return &ccResp
-		}
-
-		maxTries := 5
-		try := 1
-		var resp datadogV2.HourlyUsageResponse
-		for try <= maxTries {
-			params.FilterTimestampEnd = window.End()
-			var r *_nethttp.Response
-			resp, r, err = d.usageApi.GetHourlyUsage(d.ddCtx, *window.Start(), "all", *params)
-			if err != nil {
-				log.Errorf("Error when calling `UsageMeteringApi.GetHourlyUsage`: %v\n", err)
-				log.Errorf("Full HTTP response: %v\n", r)
-			}
+		} else {
+			ccResp.Costs = attributed
+		}
+	}
 
-			if err == nil {
-				break
-			} else {
-				if strings.Contains(err.Error(), "429") {
-					log.Errorf("rate limit reached, retrying...")
-				}
-				time.Sleep(30 * time.Second)
-				try++
-			}
+	if unitPricing.reconciliation != nil {
+		d.reconcileCosts(ccResp, usageMappings, unitPricing.reconciliation)
+	}
 
-		}
+	return ccResp
+}
 
-		if err != nil {
-			log.Errorf("after calling `UsageMeteringApi.GetHourlyUsage` %d times, still getting error: %v\n", maxTries, err)
-			ccResp.Errors = append(ccResp.Errors, err.Error())
-		}
+// getPricedCosts returns the costs of org's usage in window priced with
+// unitPricing, and the usage mappings of the costs by provider ID.
+func (d *DatadogCostSource) getPricedCosts(ctx context.Context, org *ddOrg, window opencost.Window, unitPricing *monthUnitPrices) (*pb.CustomCostResponse, map[string]datadogplugin.UsageTypeMapping) {
+	ccResp := boilerplateDDCustomCost(window)
+	derivedPricing := unitPricing.costs
+	costs := map[string]*pb.CustomCost{}
+	// usage mappings of the costs by provider ID
+	usageMappings := map[string]datadogplugin.UsageTypeMapping{}
+	// usage types we can't price are reported rather than guessed at
+	unmapped := map[string]bool{}
+	unpriced := map[string]bool{}
+	records, errs := d.getHourlyUsage(ctx, org, window, d.usageFilter.ProductFamilies())
+	ccResp.Errors = append(ccResp.Errors, errs...)
+	for index := range records {
+		// each of these entries gives hourly data steps
+		for indexMeas := range records[index].Attributes.Measurements {
+			usageQty := float32(0.0)
+
+			if records[index].Attributes.Measurements[indexMeas].Value.IsSet() {
+				usageQty = float32(records[index].Attributes.Measurements[indexMeas].GetValue())
+			}
 
-		for index := range resp.Data {
-			// each of these entries gives hourly data steps
-			for indexMeas := range resp.Data[index].Attributes.Measurements {
-				usageQty := float32(0.0)
+			if usageQty == 0.0 {
+				log.Tracef("product %s/%s had 0 usage, not recording that cost", *records[index].Attributes.ProductFamily, *records[index].Attributes.Measurements[indexMeas].UsageType)
+				continue
+			}
 
-				if resp.Data[index].Attributes.Measurements[indexMeas].Value.IsSet() {
-					usageQty = float32(resp.Data[index].Attributes.Measurements[indexMeas].GetValue())
-				}
+			productFamily := *records[index].Attributes.ProductFamily
+			usageType := *records[index].Attributes.Measurements[indexMeas].UsageType
+			if !d.usageFilter.Includes(productFamily, usageType) {
+				log.Tracef("usage type %s/%s is filtered out, not recording that cost", productFamily, usageType)
+				continue
+			}
+			// usage types reported by more than one product family are
+			// named after the mapping entry, so they aren't summed together
+			usageKey, usageMapping, found := d.usageMapping.Lookup(productFamily, usageType)
+			if !found {
+				unmapped[productFamily+"/"+usageType] = true
+				continue
+			}
+			if usageMapping.BillingDimension == "" {
+				log.Tracef("usage type %s/%s isn't billed on its own, not recording that cost", productFamily, usageType)
+				continue
+			}
+			_, hasDerived := derivedPricing[usageMapping.BillingDimension]
+			_, hasContract := d.rateCard[usageMapping.BillingDimension]
+			if !hasDerived && !hasContract {
+				unpriced[productFamily+"/"+usageType] = true
+				continue
+			}
+			publicId := *records[index].Attributes.PublicId
+			provId := publicId + "/" + usageKey
 
-				if usageQty == 0.0 {
-					log.Tracef("product %s/%s had 0 usage, not recording that cost", *resp.Data[index].Attributes.ProductFamily, *resp.Data[index].Attributes.Measurements[indexMeas].UsageType)
-					continue
+			if _, found := costs[provId]; found {
+				// we have already encountered this cost type for this window, so add to the existing usage
+				costs[provId].UsageQuantity += usageQty
+			} else {
+				// we have not encountered this cost type for this window yet, so create a new cost entry
+				// child orgs are billed to the parent org the prices were fetched with
+				accountId := unitPricing.accountId
+				if accountId == "" {
+					accountId = publicId
 				}
-
-				matched, pricing := matchUsageToPricing(*resp.Data[index].Attributes.Measurements[indexMeas].UsageType, listPricing)
-				log.Infof("matched %s to %s", *resp.Data[index].Attributes.Measurements[indexMeas].UsageType, matched)
-				provId := *resp.Data[index].Attributes.PublicId + "/" + *resp.Data[index].Attributes.Measurements[indexMeas].UsageType
-				if matched == "" {
-					log.Infof("no pricing found for %s", *resp.Data[index].Attributes.Measurements[indexMeas].UsageType)
-					continue
+				orgName := *records[index].Attributes.OrgName
+				cost := pb.CustomCost{
+					Zone:           *records[index].Attributes.Region,
+					AccountName:    orgName,
+					ChargeCategory: "Usage",
+					Description:    "nil",
+					ResourceName:   usageKey,
+					ResourceType:   productFamily,
+					Id:             *records[index].Id + "/" + usageKey,
+					ProviderId:     provId,
+					Labels:         map[string]string{},
+					UsageQuantity:  usageQty,
+					UsageUnit:      usageMapping.Unit,
+					ExtendedAttributes: &pb.CustomCostExtendedAttributes{
+						AccountId:      &accountId,
+						SubAccountId:   &publicId,
+						SubAccountName: &orgName,
+					},
 				}
 
-				billedCost := float32(pricing.Cost) * usageQty
-
-				if _, found := costs[provId]; found {
-					// we have already encountered this cost type for this window, so add to the existing cost entry
-					costs[provId].UsageQuantity += usageQty
-					costs[provId].BilledCost += billedCost
-				} else {
-					// we have not encountered this cost type for this window yet, so create a new cost entry
-					cost := pb.CustomCost{
-						Zone:               *resp.Data[index].Attributes.Region,
-						AccountName:        *resp.Data[index].Attributes.OrgName,
-						ChargeCategory:     "usage",
-						Description:        "nil",
-						ResourceName:       *resp.Data[index].Attributes.Measurements[indexMeas].UsageType,
-						ResourceType:       *resp.Data[index].Attributes.ProductFamily,
-						Id:                 *resp.Data[index].Id,
-						ProviderId:         provId,
-						Labels:             map[string]string{},
-						ListCost:           0,
-						ListUnitPrice:      0,
-						BilledCost:         billedCost,
-						UsageQuantity:      usageQty,
-						UsageUnit:          pricing.unit,
-						ExtendedAttributes: nil,
-					}
-
-					costs[provId] = &cost
-				}
+				costs[provId] = &cost
+				usageMappings[provId] = usageMapping
 			}
 		}
-		if resp.Meta != nil && resp.Meta.Pagination != nil && resp.Meta.Pagination.NextRecordId.IsSet() {
-			nextPageId = *resp.Meta.Pagination.NextRecordId.Get()
-		} else {
-			nextPageId = ""
-		}
 	}
 	allCosts := []*pb.CustomCost{}
 	for _, cost := range costs {
@@ -245,79 +389,140 @@ func (d *DatadogCostSource) getDDCostsForWindow(window opencost.Window, listPric
 	}
 	ccResp.Costs = allCosts
 
+	ccResp.Metadata["usage_mapping_version"] = d.usageMapping.Version
+	ccResp.Metadata["list_prices_version"] = d.listPrices.Version
+	ccResp.Metadata["allotments_version"] = d.allotments.Version
+	if len(unmapped) > 0 {
+		ccResp.Metadata["unmapped_usage_types"] = joinSorted(unmapped)
+		log.Warnf("usage types with no billing dimension were not priced: %s", ccResp.Metadata["unmapped_usage_types"])
+	}
+	if len(unpriced) > 0 {
+		ccResp.Metadata["unpriced_usage_types"] = joinSorted(unpriced)
+		log.Warnf("usage types with no price for their billing dimension were not priced: %s", ccResp.Metadata["unpriced_usage_types"])
+	}
+
 	// post processing
 	// datadog's usage API sometimes provides usages that get counted multiple times
 	// this post processing stage de-duplicates those usages and costs
-	postProcess(&ccResp)
-
-	return &ccResp
-}
-
-func matchUsageToPricing(usageType string, pricing map[string]billableCost) (string, *billableCost) {
-	// for the usage, remove _count from the end of the usage type
-	usageType = strings.TrimSuffix(usageType, "_count")
-
-	// not specific enough to match on
-	if usageType == "host" {
-		return "", nil
+	postProcess(&ccResp, d.allotments)
+
+	// costs are priced once all their usage in the window is known, since
+	// commitments and allotments cover usage across the whole window
+	monthShare := billingMonthShare(window)
+	windowStart := window.Start().UTC()
+	inPricingMonth := unitPricing.month.Equal(time.Date(windowStart.Year(), windowStart.Month(), 1, 0, 0, 0, 0, time.UTC))
+	billedMonthly := map[string]bool{}
+	for _, cost := range ccResp.Costs {
+		billingDimension := usageMappings[cost.ProviderId].BillingDimension
+		charge, found := unitPricing.monthlyCharges[billingDimension]
+		if !found || !inPricingMonth {
+			d.priceCost(cost, billingDimension, derivedPricing, monthShare)
+			continue
+		}
+		// the cost is billed the share of the month's charge its usage makes
+		// up, which is priced like the month's billable usage would be
+		usageShare := float64(cost.UsageQuantity) / charge.used
+		pricingQuantity := float32(charge.billable * usageShare)
+		pricingUnit := cost.UsageUnit
+		cost.ExtendedAttributes.PricingQuantity = &pricingQuantity
+		cost.ExtendedAttributes.PricingUnit = &pricingUnit
+		d.priceCost(cost, billingDimension, derivedPricing, charge.monthShare*usageShare)
+		billedMonthly[billingDimension] = true
 	}
-	// if the usage type is in the pricing map, use that
-	if _, found := pricing[usageType]; found {
-		entry := pricing[usageType]
-		return usageType, &entry
+	if len(billedMonthly) > 0 {
+		ccResp.Metadata["monthly_billed_dimensions"] = joinSorted(billedMonthly)
 	}
 
-	// break up the usage on _
-	tokens := strings.Split(usageType, "_")
-	// find the first pricing key that contains all tokens
-	for key, price := range pricing {
-		matchesAll := true
-		for _, token := range tokens {
-			if !strings.Contains(key, token) {
-				matchesAll = false
-				break
-			}
-		}
-		if matchesAll {
-			return key, &price
-		}
-	}
+	return &ccResp, usageMappings
+}
 
-	// try replacing agent with infra and checking that
-	agentAsInfra := strings.ReplaceAll(usageType, "agent", "infra")
-	tokens = strings.Split(agentAsInfra, "_")
-	// find the first pricing key that contains all tokens
-	for key, price := range pricing {
-		matchesAll := true
-		for _, token := range tokens {
-			if !strings.Contains(key, token) {
-				matchesAll = false
-				break
-			}
+// getHourlyUsage returns org's hourly usage of productFamilies in window
+// across every page, and the errors getting any of them.
+func (d *DatadogCostSource) getHourlyUsage(ctx context.Context, org *ddOrg, window opencost.Window, productFamilies string) ([]datadogV2.HourlyUsage, []string) {
+	ddCtx := org.ddContext(ctx)
+	var records []datadogV2.HourlyUsage
+	var errs []string
+	nextPageId := "init"
+	for morepages := true; morepages; morepages = (nextPageId != "") {
+		params := datadogV2.NewGetHourlyUsageOptionalParameters()
+		if nextPageId != "init" {
+			params.PageNextRecordId = &nextPageId
 		}
-		if matchesAll {
-			return key, &price
+
+		// rate limiting and retries are handled by the http client the API was built with
+		params.FilterTimestampEnd = window.End()
+		params.FilterIncludeDescendants = &org.includeChildOrgs
+		resp, r, err := org.usageApi.GetHourlyUsage(ddCtx, *window.Start(), productFamilies, *params)
+		if err != nil {
+			log.Errorf("Error when calling `UsageMeteringApi.GetHourlyUsage`: %v\n", err)
+			log.Errorf("Full HTTP response: %v\n", r)
+			errs = append(errs, err.Error())
 		}
-	}
 
-	// if still no pricing key is found, compute the levenshtein distance between the usage type and the pricing key
-	// and use the one with the smallest distance
-	smallestDist := 4000000000
-	var closestKey string
-	for key := range pricing {
-		distance := levenshtein.ComputeDistance(usageType, key)
-		if distance < smallestDist {
-			smallestDist = distance
-			closestKey = key
+		records = append(records, resp.Data...)
+		if resp.Meta != nil && resp.Meta.Pagination != nil && resp.Meta.Pagination.NextRecordId.IsSet() {
+			nextPageId = *resp.Meta.Pagination.NextRecordId.Get()
+		} else {
+			nextPageId = ""
 		}
 	}
+	return records, errs
+}
+
+// priceCost sets the list and billed costs of cost, whose usage is billed in
+// billingDimension, for a window that is monthShare of its billing month.
+// Billed costs come from the contract rate card, and list costs from the
+// public list prices. Either falls back to the price derived from Datadog's
+// estimated costs when the billing dimension is missing from it.
+// Only the cost's pricing quantity is priced, if it has one.
+func (d *DatadogCostSource) priceCost(cost *pb.CustomCost, billingDimension string, derivedPricing map[string]billableCost, monthShare float64) {
+	quantity := float64(cost.UsageQuantity)
+	if cost.ExtendedAttributes != nil && cost.ExtendedAttributes.PricingQuantity != nil {
+		quantity = float64(*cost.ExtendedAttributes.PricingQuantity)
+	}
+	derived, hasDerived := derivedPricing[billingDimension]
+	contractRate, hasContract := d.rateCard[billingDimension]
+	listPrice, hasListPrice := d.listPrices.Prices[billingDimension]
+
+	billedCost := quantity * derived.Cost
+	if hasContract {
+		billedCost = contractRate.Cost(quantity, monthShare)
+	}
+
+	var listUnitPrice float64
+	switch {
+	case hasListPrice:
+		listUnitPrice = listPrice.UnitPrice()
+	case hasDerived:
+		listUnitPrice = derived.Cost
+	default:
+		listUnitPrice = datadogplugin.ListPrice{Rate: contractRate.OnDemandRate, UnitsPerRate: contractRate.UnitsPerRate}.UnitPrice()
+	}
+
+	cost.ListUnitPrice = float32(listUnitPrice)
+	cost.ListCost = float32(quantity * listUnitPrice)
+	cost.BilledCost = float32(billedCost)
+}
 
-	// remember the pricing keys we have already matched. if we have already matched a pricing key, don't match it again
-	entry := pricing[closestKey]
-	return closestKey, &entry
+// billingMonthShare returns the fraction of its billing month window covers.
+func billingMonthShare(window opencost.Window) float64 {
+	start := window.Start().UTC()
+	monthStart := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	return window.Duration().Hours() / monthEnd.Sub(monthStart).Hours()
+}
 
+// joinSorted returns the keys of set in order, separated by commas.
+func joinSorted(set map[string]bool) string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
 }
-func postProcess(ccResp *pb.CustomCostResponse) {
+
+func postProcess(ccResp *pb.CustomCostResponse, allotments *datadogplugin.Allotments) {
 	if ccResp == nil {
 		return
 	}
@@ -326,49 +531,38 @@ func postProcess(ccResp *pb.CustomCostResponse) {
 
 	ccResp.Costs = processLogUsage(ccResp.Costs)
 
-	// DBM queries have 200 * number of hosts included. We need to adjust the costs to reflect this
-	ccResp.Costs = adjustDBMQueries(ccResp.Costs)
+	// some usage, like DBM queries, is partly included with other usage. We need to adjust the costs to reflect this
+	applyAllotments(ccResp.Costs, allotments)
 
 	// removes any items that have 0 usage, either because of post processing or otherwise
 	ccResp.Costs = removeZeroUsages(ccResp.Costs)
 }
 
-// as per https://www.datadoghq.com/pricing/?product=database-monitoring#database-monitoring-can-i-still-use-dbm-if-i-have-additional-normalized-queries-past-the-a-hrefpricingallotmentsallotteda-amount
-// the first 200 queries per host are free.
-// if that zeroes out the dbm queries, we remove the cost
-func adjustDBMQueries(costs []*pb.CustomCost) []*pb.CustomCost {
-	totalFreeQueries := float32(0.0)
-	for index := 0; index < len(costs); index++ {
-		if costs[index].ResourceName == "dbm_host_count" {
-			hostCount := costs[index].UsageQuantity
-			totalFreeQueries += 200 * float32(hostCount)
-		}
+// applyAllotments sets the pricing quantity of each cost with an allotment to
+// its usage above what is included with the usage granting the allotment in
+// the same org, e.g. the 200 normalized queries included with each DBM host as
+// per https://www.datadoghq.com/pricing/?product=database-monitoring#database-monitoring-can-i-still-use-dbm-if-i-have-additional-normalized-queries-past-the-a-hrefpricingallotmentsallotteda-amount
+func applyAllotments(costs []*pb.CustomCost, allotments *datadogplugin.Allotments) {
+	usage := map[string]float64{}
+	for _, cost := range costs {
+		usage[cost.AccountName+"/"+cost.ResourceName] += float64(cost.UsageQuantity)
 	}
-	log.Debugf("total free queries: %f", totalFreeQueries)
 
-	for index := 0; index < len(costs); index++ {
-		if costs[index].ResourceName == "dbm_queries_count" {
-			costs[index].UsageQuantity -= totalFreeQueries
-			log.Debugf("adjusted dbm queries: %v", costs[index])
+	for _, cost := range costs {
+		allotment, found := allotments.Allotments[cost.ResourceName]
+		if !found || allotment.Quantity == 0 {
+			continue
 		}
-
-	}
-
-	for index := 0; index < len(costs); index++ {
-		if costs[index].ResourceName == "dbm_queries_count" {
-			if costs[index].UsageQuantity <= 0 {
-				log.Debugf("removing cost %s because it has 0 usage", costs[index].ProviderId)
-				costs = append(costs[:index], costs[index+1:]...)
-				index = 0
-			} else {
-				// TODO else, multiply cost by the rate for extra queries
-				costs[index].ListCost = 0.0
-				costs[index].ListUnitPrice = 0.0
-				costs[index].UsageUnit = "queries"
-			}
+		included := allotment.Included(usage[cost.AccountName+"/"+allotment.GrantedBy])
+		pricingQuantity := float32(max(float64(cost.UsageQuantity)-included, 0))
+		pricingUnit := cost.UsageUnit
+		if cost.ExtendedAttributes == nil {
+			cost.ExtendedAttributes = &pb.CustomCostExtendedAttributes{}
 		}
+		cost.ExtendedAttributes.PricingQuantity = &pricingQuantity
+		cost.ExtendedAttributes.PricingUnit = &pricingUnit
+		log.Debugf("%f of %f %s of %s are included with %s", min(included, float64(cost.UsageQuantity)), cost.UsageQuantity, cost.UsageUnit, cost.ResourceName, allotment.GrantedBy)
 	}
-	return costs
 }
 
 // removes any items that have 0 usage or cost, either because of post processing or otherwise
@@ -377,10 +571,6 @@ func removeZeroUsages(costs []*pb.CustomCost) []*pb.CustomCost {
 	for index := 0; index < len(costs); index++ {
 		log.Tracef("POST - looking at cost %s with usage %f", costs[index].ResourceName, costs[index].UsageQuantity)
 		if costs[index].UsageQuantity < 0.001 && costs[index].ListCost == 0.0 && costs[index].BilledCost == 0.0 {
-			if costs[index].ResourceName == "dbm_queries_count" {
-				log.Tracef("leaving dbm queries cost in place")
-				continue
-			}
 			log.Tracef("POST -removing cost %s because it has 0 usage", costs[index].ProviderId)
 			costs = append(costs[:index], costs[index+1:]...)
 			log.Tracef("POST - costs is now %d", len(costs))
@@ -440,15 +630,14 @@ func processLogUsage(costs []*pb.CustomCost) []*pb.CustomCost {
 		}
 
 		logsIndexed.Description = "other log events"
-		logsIndexed.UsageQuantity = leftoverLogs
+		logsIndexed.UsageQuantity = max(leftoverLogs, 0)
 		logsIndexed.ResourceName = "other_log_events"
-		logsIndexed.ListCost = leftoverLogs * logsIndexed.ListUnitPrice
 		costs = append(costs, logsIndexed)
 	}
 	return costs
 }
 
-func getDatadogClients(config datadogplugin.DatadogConfig) (context.Context, *datadogV2.UsageMeteringApi, *datadogV1.UsageMeteringApi) {
+func getDatadogClients(config datadogplugin.DatadogOrg, rateLimiter *rate.Limiter) (context.Context, *datadogV2.UsageMeteringApi, *datadogV1.UsageMeteringApi) {
 	ddctx := datadog.NewDefaultContext(context.Background())
 	ddctx = context.WithValue(
 		ddctx,
@@ -468,100 +657,115 @@ func getDatadogClients(config datadogplugin.DatadogConfig) (context.Context, *da
 	)
 
 	configuration := datadog.NewConfiguration()
+	// all usage metering endpoints share one rate limit, and datadog tells us
+	// how long to back off for when we hit it
+	configuration.HTTPClient = httpclient.NewClient(httpclient.Config{
+		HostLimiters: map[string]*rate.Limiter{
+			"api." + config.DDSite: rateLimiter,
+		},
+	})
 	apiClient := datadog.NewAPIClient(configuration)
 	usageAPI := datadogV2.NewUsageMeteringApi(apiClient)
 	v1UsageAPI := datadogV1.NewUsageMeteringApi(apiClient)
 	return ddctx, usageAPI, v1UsageAPI
 }
 
-func getDatadogConfig(configFilePath string) (*datadogplugin.DatadogConfig, error) {
-	var result datadogplugin.DatadogConfig
-	bytes, err := os.ReadFile(configFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file for DD config @ %s: %v", configFilePath, err)
-	}
-	err = json.Unmarshal(bytes, &result)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling json into DD config %v", err)
-	}
+// GetDDUnitPrices returns the unit prices to price org's usage in the window
+// starting at windowStart with, which are those of the window's billing month.
+// Prices are cached per org and billing month.
+func (d *DatadogCostSource) GetDDUnitPrices(ctx context.Context, org *ddOrg, windowStart time.Time) (*monthUnitPrices, error) {
+	// DD estimated costs can be delayed 72 hours
+	// so ensure we are going far enough back
+	stableTimeframe := time.Now().UTC().Add(-3 * 24 * time.Hour)
+	stableMonth := time.Date(stableTimeframe.Year(), stableTimeframe.Month(), 1, 0, 0, 0, 0, time.UTC)
 
-	if result.DDLogLevel == "" {
-		result.DDLogLevel = "info"
+	// windows in a month with no costs yet are priced with the month before
+	targetMonth := time.Date(windowStart.Year(), windowStart.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if targetMonth.After(stableMonth) {
+		targetMonth = stableMonth
 	}
 
-	return &result, nil
+	return org.unitPrices.get(ctx, targetMonth, func() (*monthUnitPrices, error) {
+		prices, err := d.getDDUnitPricesForMonth(ctx, org, targetMonth, stableTimeframe)
+		if err != nil {
+			return nil, err
+		}
+		// monthly charges and the reconciliation are cached along with the
+		// prices they were made with
+		prices.monthlyCharges, prices.chargesEnd, err = d.getMonthlyCharges(ctx, org, prices)
+		if err != nil {
+			return nil, err
+		}
+		if d.reconciliation == "" {
+			return prices, nil
+		}
+		prices.reconciliation = d.reconcileMonth(ctx, org, prices)
+		return prices, nil
+	})
 }
 
-func (d *DatadogCostSource) GetDDUnitPrices(windowStart time.Time) (map[string]billableCost, error) {
-
-	// DD estimated costs can be delayed 72 hours
-	// so ensure we are going far enough back
-	stableTimeframe := time.Now().UTC().Add(-3 * 24 * time.Hour)
+// getDDUnitPricesForMonth derives unit prices from the cost and billable usage
+// of org in targetMonth. Closed months are priced with their historical cost once
+// Datadog has finalized it, and other months with their estimated cost up to
+// stableTimeframe.
+func (d *DatadogCostSource) getDDUnitPricesForMonth(ctx context.Context, org *ddOrg, targetMonth, stableTimeframe time.Time) (*monthUnitPrices, error) {
+	ddCtx := org.ddContext(ctx)
 
-	targetMonth := time.Date(stableTimeframe.Year(), stableTimeframe.Month(), 1, 0, 0, 0, 0, time.UTC)
-	targetMonthEnd := time.Date(stableTimeframe.Year(), stableTimeframe.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	targetMonthEnd := targetMonth.AddDate(0, 1, 0)
 	// first, get the billable usage for the month
 	opts := datadogV1.GetUsageBillableSummaryOptionalParameters{
 		Month: &targetMonth,
 	}
-	var respBillableUsage datadogV1.UsageBillableSummaryResponse
-	var err error
-	for try := 1; try <= 5; {
-		respBillableUsage, _, err = d.v1UsageApi.GetUsageBillableSummary(d.ddCtx, opts)
-		if err == nil {
-			break
-		} else {
-			if strings.Contains(err.Error(), "429") {
-				log.Errorf("rate limit reached, retrying...")
-			} else {
-				break
-			}
-			time.Sleep(30 * time.Second)
-			try++
-		}
-
-	}
+	respBillableUsage, _, err := org.v1UsageApi.GetUsageBillableSummary(ddCtx, opts)
 	if err != nil {
 		return nil, fmt.Errorf("error getting usage billable usage summary: %v", err)
 	}
-	// then, get the estimated cost for the month
-	// the start date should be the beginning of the month
-	// the end date should be the end of the last month, or the stable time frame, depending on if we are in the first 3 days of the new month or not
-	endDateToUse := targetMonthEnd
-	if time.Now().Before(targetMonthEnd) {
-		endDateToUse = stableTimeframe
-	}
 
-	costOpts := datadogV2.GetEstimatedCostByOrgOptionalParameters{
-		StartDate: &targetMonth,
-		EndDate:   &endDateToUse,
+	// then, get the cost for the month. Historical costs are only available
+	// for closed months, some time into the next month.
+	var costData []datadogV2.CostByOrg
+	final := false
+	if !time.Now().Before(targetMonthEnd) {
+		historicalOpts := datadogV2.GetHistoricalCostByOrgOptionalParameters{
+			EndMonth: &targetMonth,
+		}
+		respHistoricalCost, _, err := org.usageApi.GetHistoricalCostByOrg(ddCtx, targetMonth, historicalOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error getting historical cost by org: %v", err)
+		}
+		costData = respHistoricalCost.Data
+		final = len(costData) > 0
 	}
-	var respEstimatedCost datadogV2.CostByOrgResponse
-	for try := 1; try <= 5; {
-		respEstimatedCost, _, err = d.usageApi.GetEstimatedCostByOrg(d.ddCtx, costOpts)
 
-		if err == nil {
-			break
-		} else {
-			if strings.Contains(err.Error(), "429") {
-				log.Errorf("rate limit reached, retrying...")
-			} else {
-				break
-			}
-			time.Sleep(30 * time.Second)
-			try++
+	costsEnd := targetMonthEnd
+	if !final {
+		// the start date should be the beginning of the month
+		// the end date should be the end of the month, or the stable time frame, depending on if the month is over
+		endDateToUse := targetMonthEnd
+		if stableTimeframe.Before(targetMonthEnd) {
+			endDateToUse = stableTimeframe
 		}
-	}
 
-	if err != nil {
-		return nil, fmt.Errorf("after calling `UsageMeteringApi.GetEstimatedCostByOrg` %d times, still getting error: %v", 5, err)
+		costOpts := datadogV2.GetEstimatedCostByOrgOptionalParameters{
+			StartDate: &targetMonth,
+			EndDate:   &endDateToUse,
+		}
+		respEstimatedCost, _, err := org.usageApi.GetEstimatedCostByOrg(ddCtx, costOpts)
+		if err != nil {
+			return nil, fmt.Errorf("error getting estimated cost by org: %v", err)
+		}
+		costData = respEstimatedCost.Data
+		costsEnd = endDateToUse
+	}
+	if len(costData) == 0 {
+		return nil, fmt.Errorf("no costs found for %s", targetMonth.Format("2006-01"))
 	}
 
 	// now, we need to calculate the unit prices
-	// the unit price is the estimated cost divided by the billable usage
+	// the unit price is the cost divided by the billable usage
 	// we need to do this for each product family
 	costsByFamily := make(map[string]float64)
-	latestCosts := respEstimatedCost.Data[len(respEstimatedCost.Data)-1]
+	latestCosts := costData[len(costData)-1]
 	attrs := latestCosts.Attributes
 	for _, charge := range attrs.Charges {
 		if *charge.ChargeType != "total" {
@@ -570,6 +774,9 @@ func (d *DatadogCostSource) GetDDUnitPrices(windowStart time.Time) (map[string]b
 		costsByFamily[*charge.ProductName] = float64(*charge.Cost)
 	}
 
+	// share of the month the costs cover, which monthly billed usage is
+	// prorated to
+	coveredShare := costsEnd.Sub(targetMonth).Hours() / targetMonthEnd.Sub(targetMonth).Hours()
 	result := make(map[string]billableCost)
 	for _, usage := range respBillableUsage.Usage {
 		log.Debugf("usage: %v", usage)
@@ -579,9 +786,15 @@ func (d *DatadogCostSource) GetDDUnitPrices(windowStart time.Time) (map[string]b
 				continue
 			}
 			// if the product family has 'hosts' in it, then the usage is per month
-			// so we need to adjust the cost to be per hour
+			// so we need to adjust the cost to be per hour. Products with a
+			// billing model are billed the month's units for the hours the
+			// costs cover, which the monthly charges are priced in.
 			isRated := false
-			if strings.Contains(productName, "host") {
+			switch {
+			case d.listPrices.Prices[productName].BilledMonthly():
+				isRated = true
+				cost /= hoursPerMonth * coveredShare
+			case strings.Contains(productName, "host"):
 				isRated = true
 				cost /= float64(730)
 			}
@@ -595,7 +808,41 @@ func (d *DatadogCostSource) GetDDUnitPrices(windowStart time.Time) (map[string]b
 		}
 	}
 
-	return result, nil
+	var accountId string
+	if attrs.PublicId != nil {
+		accountId = *attrs.PublicId
+	}
+
+	return &monthUnitPrices{
+		month:     targetMonth,
+		costs:     result,
+		final:     final,
+		accountId: accountId,
+		totals:    costsByFamily,
+		costsEnd:  costsEnd,
+	}, nil
+}
+
+// monthUnitPrices are the unit prices of a billing month.
+type monthUnitPrices struct {
+	month time.Time
+	costs map[string]billableCost
+	// final is set when the prices come from the month's historical cost, so
+	// they can no longer change
+	final bool
+	// accountId is the public ID of the org billed for the month's costs
+	accountId string
+	// totals are Datadog's costs of each billing dimension from the start of
+	// the month until costsEnd
+	totals   map[string]float64
+	costsEnd time.Time
+	// monthlyCharges are the charges of the billing dimensions billed for the
+	// month as a whole, for their usage from the start of the month until
+	// chargesEnd
+	monthlyCharges map[string]monthlyCharge
+	chargesEnd     time.Time
+	// reconciliation is nil unless reconciliation is enabled
+	reconciliation *monthReconciliation
 }
 
 type billableCost struct {
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-api-client-go/v2/api/datadog"
+	"github.com/opencost/opencost-plugins/common/cache"
+	"github.com/opencost/opencost-plugins/common/validation"
 	datadogplugin "github.com/opencost/opencost-plugins/pkg/plugins/datadog/datadogplugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
 	"github.com/opencost/opencost/core/pkg/util/timeutil"
 	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/types/known/durationpb"
@@ -46,10 +58,10 @@ func TestGetCustomCosts(t *testing.T) {
 	}
 
 	rateLimiter := rate.NewLimiter(0.25, 5)
-	ddCostSrc := DatadogCostSource{
-		rateLimiter: rateLimiter,
+	ddCostSrc, err := newDatadogCostSource(&config, rateLimiter)
+	if err != nil {
+		t.Fatalf("error creating cost source: %v", err)
 	}
-	ddCostSrc.ddCtx, ddCostSrc.usageApi, ddCostSrc.v1UsageApi = getDatadogClients(config)
 	windowStart := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
 	// query for qty 2 of 1 hour windows
 	windowEnd := time.Date(2024, 10, 17, 0, 0, 0, 0, time.UTC)
@@ -67,3 +79,920 @@ func TestGetCustomCosts(t *testing.T) {
 		t.Fatalf("empty response")
 	}
 }
+
+// newTestCostSource returns a cost source whose datadog clients send every
+// request to handler instead of the datadog API.
+func newTestCostSource(t *testing.T, ddConfig datadogplugin.DatadogConfig, handler http.Handler) *DatadogCostSource {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	ddConfig.DDSite = "datadoghq.com"
+	ddConfig.DDAPIKey = "api-key"
+	ddConfig.DDAppKey = "app-key"
+	ddCostSrc, err := newDatadogCostSource(&ddConfig, rate.NewLimiter(rate.Inf, 1))
+	if err != nil {
+		t.Fatalf("error creating cost source: %v", err)
+	}
+	// each org's v1 and v2 APIs share a client
+	for _, org := range ddCostSrc.orgs {
+		org.usageApi.Client.GetConfig().Servers = datadog.ServerConfigurations{{URL: srv.URL}}
+	}
+	return ddCostSrc
+}
+
+// hourlyUsageHandler serves a single page of hourly usage for the infra_hosts
+// product family with the given usage type quantities.
+func hourlyUsageHandler(usage map[string]float64) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/usage/hourly_usage", func(w http.ResponseWriter, r *http.Request) {
+		measurements := []map[string]any{}
+		for usageType, value := range usage {
+			measurements = append(measurements, map[string]any{"usage_type": usageType, "value": value})
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": []map[string]any{{
+				"id":   "record",
+				"type": "usage_timeseries",
+				"attributes": map[string]any{
+					"org_name":       "org",
+					"public_id":      "public",
+					"region":         "us",
+					"product_family": "infra_hosts",
+					"measurements":   measurements,
+				},
+			}},
+		})
+	})
+	return mux
+}
+
+func TestGetDDCostsForWindowUsageMapping(t *testing.T) {
+	usage := map[string]float64{
+		"agent_host_count":   10,
+		"host_count":         12,
+		"apm_host_count":     2,
+		"mystery_host_count": 5,
+	}
+	pricing := map[string]billableCost{
+		"infra_host": {ProductName: "infra_host", Cost: 0.5},
+	}
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	t.Run("default mapping", func(t *testing.T) {
+		ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{}, hourlyUsageHandler(usage))
+		resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: pricing})
+
+		if len(resp.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		if len(resp.Costs) != 1 {
+			t.Fatalf("expected only the agent hosts to be priced, got %v", resp.Costs)
+		}
+		cost := resp.Costs[0]
+		if cost.ResourceName != "agent_host_count" || cost.UsageUnit != "host-hours" || cost.BilledCost != 5 || cost.ListUnitPrice != float32(18.0/730) {
+			t.Errorf("unexpected cost: %v", cost)
+		}
+		if resp.Metadata["unmapped_usage_types"] != "infra_hosts/mystery_host_count" {
+			t.Errorf("unexpected unmapped usage types: %q", resp.Metadata["unmapped_usage_types"])
+		}
+		if resp.Metadata["unpriced_usage_types"] != "infra_hosts/apm_host_count" {
+			t.Errorf("unexpected unpriced usage types: %q", resp.Metadata["unpriced_usage_types"])
+		}
+		if resp.Metadata["usage_mapping_version"] == "" {
+			t.Errorf("expected the usage mapping version in the metadata")
+		}
+	})
+
+	t.Run("overridden mapping", func(t *testing.T) {
+		ddConfig := datadogplugin.DatadogConfig{
+			UsageMapping: datadogplugin.UsageMapping{
+				Version: "test",
+				UsageTypes: map[string]datadogplugin.UsageTypeMapping{
+					"infra_hosts/mystery_host_count": {BillingDimension: "infra_host", Unit: "host-hours"},
+				},
+			},
+		}
+		ddCostSrc := newTestCostSource(t, ddConfig, hourlyUsageHandler(usage))
+		resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: pricing})
+
+		if len(resp.Costs) != 2 {
+			t.Fatalf("expected the agent and mystery hosts to be priced, got %v", resp.Costs)
+		}
+		if _, found := resp.Metadata["unmapped_usage_types"]; found {
+			t.Errorf("expected no unmapped usage types, got %q", resp.Metadata["unmapped_usage_types"])
+		}
+		if !strings.HasSuffix(resp.Metadata["usage_mapping_version"], "+test") {
+			t.Errorf("expected the override version in %q", resp.Metadata["usage_mapping_version"])
+		}
+	})
+}
+
+func TestGetDDCostsForWindowRateCard(t *testing.T) {
+	usage := map[string]float64{
+		"agent_host_count": 10,
+		"dbm_host_count":   4,
+		"apm_host_count":   2,
+	}
+	derived := map[string]billableCost{
+		"infra_host": {ProductName: "infra_host", Cost: 0.02},
+		"dbm_host":   {ProductName: "dbm_host", Cost: 0.1},
+	}
+	ddConfig := datadogplugin.DatadogConfig{
+		RateCard: map[string]datadogplugin.ContractRate{
+			// 5 hosts committed to at $10 a month, and $15 a month above that
+			"infra_host": {OnDemandRate: 15, CommittedRate: 10, CommittedQuantity: 5, UnitsPerRate: 730},
+			"apm_host":   {OnDemandRate: 0.03},
+		},
+	}
+	// a 30 day month, so the window is 1/720th of it
+	start := time.Date(2024, 11, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	ddCostSrc := newTestCostSource(t, ddConfig, hourlyUsageHandler(usage))
+	// leave apm hosts with neither a list price nor a derived price
+	delete(ddCostSrc.listPrices.Prices, "apm_host")
+	resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: derived})
+
+	costs := map[string]*pb.CustomCost{}
+	for _, cost := range resp.Costs {
+		costs[cost.ResourceName] = cost
+	}
+	if len(costs) != 3 {
+		t.Fatalf("expected 3 costs, got %v", resp.Costs)
+	}
+
+	// 5*730/720 host-hours are committed, and the rest are on-demand
+	committed := 5.0 * 730 / 720
+	expectedBilled := float32((committed*10 + (10-committed)*15) / 730)
+	infra := costs["agent_host_count"]
+	if math.Abs(float64(infra.BilledCost-expectedBilled)) > 1e-6 {
+		t.Errorf("expected agent hosts to be billed %f from the rate card, got %f", expectedBilled, infra.BilledCost)
+	}
+	if math.Abs(float64(infra.ListCost-float32(10*18.0/730))) > 1e-6 {
+		t.Errorf("expected agent hosts list cost from the list price, got %f", infra.ListCost)
+	}
+
+	// no contract rate, so billed at the derived price
+	dbm := costs["dbm_host_count"]
+	if math.Abs(float64(dbm.BilledCost-0.4)) > 1e-6 {
+		t.Errorf("expected dbm hosts to be billed at the derived price, got %f", dbm.BilledCost)
+	}
+	if math.Abs(float64(dbm.ListCost-float32(4*84.0/730))) > 1e-6 {
+		t.Errorf("expected dbm hosts list cost from the list price, got %f", dbm.ListCost)
+	}
+
+	// only a contract rate, so listed at the on-demand rate
+	apm := costs["apm_host_count"]
+	if math.Abs(float64(apm.BilledCost-0.06)) > 1e-6 || math.Abs(float64(apm.ListCost-0.06)) > 1e-6 {
+		t.Errorf("expected apm hosts to be billed and listed at the on-demand rate, got %v", apm)
+	}
+}
+
+// fakePricingAPI serves a month's billable usage of 10 infra hosts, an
+// estimated cost of $73 for them prorated to the part of the month estimated
+// and, if historical is set, a historical cost
+// of $146 for them, counting the requests for each.
+type fakePricingAPI struct {
+	historical           bool
+	billableSummaryCalls atomic.Int32
+	estimatedCostCalls   atomic.Int32
+	historicalCostCalls  atomic.Int32
+}
+
+func (f *fakePricingAPI) register(mux *http.ServeMux) {
+	costs := func(cost float64) map[string]any {
+		return map[string]any{
+			"id":   "cost",
+			"type": "cost_by_org",
+			"attributes": map[string]any{
+				"org_name":  "org",
+				"public_id": "public",
+				"charges": []map[string]any{
+					{"product_name": "infra_host", "charge_type": "total", "cost": cost},
+				},
+			},
+		}
+	}
+
+	mux.HandleFunc("/api/v1/usage/billable-summary", func(w http.ResponseWriter, r *http.Request) {
+		f.billableSummaryCalls.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"usage": []map[string]any{{
+				"org_name":  "org",
+				"public_id": "public",
+				"usage": map[string]any{
+					"infra_host_top99p": map[string]any{
+						"account_billable_usage": 10,
+						"usage_unit":             "hosts",
+						"billing_dimension":      "infra_host",
+					},
+				},
+			}},
+		})
+	})
+	mux.HandleFunc("/api/v2/usage/estimated_cost", func(w http.ResponseWriter, r *http.Request) {
+		f.estimatedCostCalls.Add(1)
+		// the month's hosts are billed for the part of the month estimated
+		start, startErr := time.Parse(time.RFC3339, r.URL.Query().Get("start_date"))
+		end, endErr := time.Parse(time.RFC3339, r.URL.Query().Get("end_date"))
+		if startErr != nil || endErr != nil {
+			http.Error(w, "invalid estimated cost range", http.StatusBadRequest)
+			return
+		}
+		monthShare := end.Sub(start).Hours() / start.AddDate(0, 1, 0).Sub(start).Hours()
+		json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{costs(73 * monthShare)}})
+	})
+	mux.HandleFunc("/api/v2/usage/historical_cost", func(w http.ResponseWriter, r *http.Request) {
+		f.historicalCostCalls.Add(1)
+		data := []map[string]any{}
+		if f.historical {
+			data = append(data, costs(146))
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+}
+
+func TestGetCustomCostsCachesUnitPrices(t *testing.T) {
+	pricingAPI := &fakePricingAPI{}
+	mux := http.NewServeMux()
+	pricingAPI.register(mux)
+	mux.Handle("/api/v2/usage/hourly_usage", hourlyUsageHandler(map[string]float64{"agent_host_count": 10}))
+	ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{}, mux)
+
+	// a day of hourly windows that are all priced with the same month's prices
+	windowStart := time.Now().UTC().Add(-4 * 24 * time.Hour).Truncate(24 * time.Hour)
+	req := &pb.CustomCostRequest{
+		Start:      timestamppb.New(windowStart),
+		End:        timestamppb.New(windowStart.Add(24 * time.Hour)),
+		Resolution: durationpb.New(time.Hour),
+	}
+	for i := 0; i < 2; i++ {
+		resps := ddCostSrc.GetCustomCosts(req)
+		if len(resps) != 24 {
+			t.Fatalf("expected 24 responses, got %d", len(resps))
+		}
+		for _, resp := range resps {
+			if len(resp.Errors) != 0 {
+				t.Fatalf("unexpected errors: %v", resp.Errors)
+			}
+			if len(resp.Costs) != 1 || math.Abs(float64(resp.Costs[0].BilledCost-0.1)) > 1e-6 {
+				t.Fatalf("expected 10 hosts at $0.01 an hour, got %v", resp.Costs)
+			}
+		}
+	}
+
+	if pricingAPI.billableSummaryCalls.Load() != 1 || pricingAPI.estimatedCostCalls.Load() != 1 {
+		t.Errorf("expected unit prices to be fetched once, got %d billable summary and %d estimated cost calls", pricingAPI.billableSummaryCalls.Load(), pricingAPI.estimatedCostCalls.Load())
+	}
+}
+
+func TestGetCustomCostsPricingMonth(t *testing.T) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	stable := time.Now().UTC().Add(-72 * time.Hour)
+	// the first month after the one the latest windows are priced with
+	nextMonth := time.Date(stable.Year(), stable.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		windowStart   time.Time
+		historical    bool
+		expectedMonth string
+		expectedCost  float32
+		// finalPrices marks the prices of the pricing month final
+		finalPrices   bool
+		expectedState string
+	}{
+		{
+			name:          "closed month with historical costs",
+			windowStart:   time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			historical:    true,
+			expectedMonth: "2024-03",
+			expectedCost:  2 * 0.2 * 24,
+			expectedState: cache.StatusFinal,
+		},
+		{
+			name:          "closed month without historical costs yet",
+			windowStart:   time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			expectedMonth: "2024-03",
+			expectedCost:  0.2 * 24,
+			expectedState: cache.StatusEstimated,
+		},
+		{
+			name:          "month with no costs yet",
+			windowStart:   today,
+			expectedMonth: stable.Format("2006-01"),
+			expectedCost:  0.2 * 24,
+			expectedState: cache.StatusEstimated,
+		},
+		{
+			name:          "month with no costs yet priced with a final month",
+			windowStart:   nextMonth,
+			expectedMonth: stable.Format("2006-01"),
+			expectedCost:  0.2 * 24,
+			finalPrices:   true,
+			expectedState: cache.StatusEstimated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pricingAPI := &fakePricingAPI{historical: tt.historical}
+			mux := http.NewServeMux()
+			pricingAPI.register(mux)
+			// 20 hosts an hour for a day
+			mux.Handle("/api/v2/usage/hourly_usage", hourlyUsageHandler(map[string]float64{"agent_host_count": 20 * 24}))
+			ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{}, mux)
+
+			if tt.finalPrices {
+				prices, err := ddCostSrc.GetDDUnitPrices(context.Background(), ddCostSrc.orgs[0], tt.windowStart)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				prices.final = true
+			}
+
+			end := tt.windowStart.Add(24 * time.Hour)
+			window := opencost.NewWindow(&tt.windowStart, &end)
+			resp, err := ddCostSrc.getCostsForWindow(context.Background(), window)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Metadata["pricing_month"] != tt.expectedMonth {
+				t.Errorf("expected pricing month %s, got %s", tt.expectedMonth, resp.Metadata["pricing_month"])
+			}
+			if resp.Metadata[cache.StatusMetadataKey] != tt.expectedState {
+				t.Errorf("expected cost status %s, got %s", tt.expectedState, resp.Metadata[cache.StatusMetadataKey])
+			}
+			if len(resp.Costs) != 1 || math.Abs(float64(resp.Costs[0].BilledCost-tt.expectedCost)) > 1e-4 {
+				t.Errorf("expected a billed cost of %f, got %v", tt.expectedCost, resp.Costs)
+			}
+		})
+	}
+}
+
+func TestGetDDCostsForWindowAllotments(t *testing.T) {
+	usage := map[string]float64{
+		"dbm_host_count":             2,
+		"dbm_queries_count":          500,
+		"agent_host_count":           10,
+		"container_count_excl_agent": 20,
+		"num_custom_timeseries":      1500,
+	}
+	derived := map[string]billableCost{
+		"dbm_host":        {ProductName: "dbm_host", Cost: 0.1},
+		"dbm_queries":     {ProductName: "dbm_queries", Cost: 0.001},
+		"infra_host":      {ProductName: "infra_host", Cost: 0.02},
+		"infra_container": {ProductName: "infra_container", Cost: 0.002},
+		"timeseries":      {ProductName: "timeseries", Cost: 0.00005},
+	}
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	costsByName := func(ddConfig datadogplugin.DatadogConfig) map[string]*pb.CustomCost {
+		ddCostSrc := newTestCostSource(t, ddConfig, hourlyUsageHandler(usage))
+		resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: derived})
+		costs := map[string]*pb.CustomCost{}
+		for _, cost := range resp.Costs {
+			costs[cost.ResourceName] = cost
+		}
+		return costs
+	}
+
+	costs := costsByName(datadogplugin.DatadogConfig{})
+	// 400 of the queries are included with the 2 dbm hosts
+	queries := costs["dbm_queries_count"]
+	if queries == nil || queries.UsageQuantity != 500 || queries.ExtendedAttributes.GetPricingQuantity() != 100 {
+		t.Fatalf("expected 100 of 500 dbm queries to be priced, got %v", queries)
+	}
+	if math.Abs(float64(queries.BilledCost-0.1)) > 1e-6 {
+		t.Errorf("expected dbm query overage to be billed at the derived rate, got %f", queries.BilledCost)
+	}
+	// all containers are included with the 10 agent hosts
+	containers := costs["container_count_excl_agent"]
+	if containers == nil || containers.ExtendedAttributes.GetPricingQuantity() != 0 || containers.BilledCost != 0 || containers.ListCost != 0 {
+		t.Errorf("expected containers to be included with the hosts, got %v", containers)
+	}
+	// 1000 of the custom metrics are included with the 10 agent hosts
+	timeseries := costs["num_custom_timeseries"]
+	if timeseries == nil || timeseries.UsageQuantity != 1500 || timeseries.ExtendedAttributes.GetPricingQuantity() != 500 {
+		t.Fatalf("expected 500 of 1500 custom metrics to be priced, got %v", timeseries)
+	}
+	if math.Abs(float64(timeseries.BilledCost-0.025)) > 1e-6 {
+		t.Errorf("expected custom metrics overage to be billed at the derived rate, got %f", timeseries.BilledCost)
+	}
+	// listed at $5 per 100 custom metrics a month
+	if math.Abs(float64(timeseries.ListCost-500*5/73000.0)) > 1e-6 {
+		t.Errorf("expected custom metrics overage to be listed at the public rate, got %f", timeseries.ListCost)
+	}
+	// usage without an allotment is priced in full
+	if hosts := costs["agent_host_count"]; hosts == nil || hosts.ExtendedAttributes.PricingQuantity != nil || math.Abs(float64(hosts.BilledCost-0.2)) > 1e-6 {
+		t.Errorf("expected agent hosts to be priced in full, got %v", hosts)
+	}
+
+	costs = costsByName(datadogplugin.DatadogConfig{
+		Allotments: datadogplugin.Allotments{
+			Allotments: map[string]datadogplugin.Allotment{
+				"container_count_excl_agent": {GrantedBy: "agent_host_count", Quantity: 0},
+			},
+		},
+	})
+	if containers := costs["container_count_excl_agent"]; containers == nil || math.Abs(float64(containers.BilledCost-0.04)) > 1e-6 {
+		t.Errorf("expected containers to be priced in full with the allotment disabled, got %v", containers)
+	}
+}
+
+func TestGetDDCostsForWindowAttribution(t *testing.T) {
+	usage := map[string]float64{
+		"agent_host_count":           40,
+		"container_count_excl_agent": 500,
+		"dbm_host_count":             1,
+	}
+	derived := map[string]billableCost{
+		"infra_host":      {ProductName: "infra_host", Cost: 0.1},
+		"infra_container": {ProductName: "infra_container", Cost: 0.01},
+		"dbm_host":        {ProductName: "dbm_host", Cost: 0.5},
+	}
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(2 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	var attributionCalls sync.Map
+	mux := http.NewServeMux()
+	mux.Handle("/api/v2/usage/hourly_usage", hourlyUsageHandler(usage))
+	mux.HandleFunc("/api/v1/usage/hourly-attribution", func(w http.ResponseWriter, r *http.Request) {
+		if keys := r.URL.Query().Get("tag_breakdown_keys"); keys != "team,service" {
+			t.Errorf("unexpected tag breakdown keys %q", keys)
+		}
+		usageType := r.URL.Query().Get("usage_type")
+		calls, _ := attributionCalls.LoadOrStore(usageType, new(atomic.Int32))
+		calls.(*atomic.Int32).Add(1)
+		// the whole day is fetched at once
+		if startHr := r.URL.Query().Get("start_hr"); !strings.HasPrefix(startHr, "2024-10-16T00") {
+			t.Errorf("unexpected start hour %q", startHr)
+		}
+		body := func(publicId string, hour int, tags map[string][]string, usage float64) map[string]any {
+			return map[string]any{
+				"org_name":        "org",
+				"public_id":       publicId,
+				"hour":            start.Add(time.Duration(hour) * time.Hour).Format(time.RFC3339),
+				"tags":            tags,
+				"total_usage_sum": usage,
+			}
+		}
+		var usage []map[string]any
+		switch usageType {
+		case "infra_host_usage":
+			usage = []map[string]any{
+				// web is attributed usage in both hours
+				body("public", 0, map[string][]string{"team": {"web"}, "service": {"api"}}, 15),
+				body("public", 1, map[string][]string{"team": {"web"}, "service": {"api"}}, 15),
+				body("public", 1, map[string][]string{"team": {"db"}}, 10),
+				// after the window
+				body("public", 5, map[string][]string{"team": {"db"}}, 1000),
+				// another org with the same name
+				body("other-public", 0, map[string][]string{"team": {"other"}}, 1000),
+			}
+		case "container_excl_agent_usage":
+			usage = []map[string]any{
+				body("public", 0, map[string][]string{"team": {"web"}}, 100),
+				body("public", 1, map[string][]string{}, 400),
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"usage": usage})
+	})
+	ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{AttributionTags: []string{"team", "service"}}, mux)
+	// the allotments would make containers free
+	ddCostSrc.allotments.Allotments = nil
+
+	resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: derived})
+	if len(resp.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	// the next window of the day reuses the day's attributed usage
+	nextEnd := end.Add(2 * time.Hour)
+	if next := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], opencost.NewWindow(&end, &nextEnd), &monthUnitPrices{costs: derived}); len(next.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", next.Errors)
+	}
+	attributionCalls.Range(func(usageType, calls any) bool {
+		if calls.(*atomic.Int32).Load() != 1 {
+			t.Errorf("expected attribution of %s to be fetched once, got %d calls", usageType, calls.(*atomic.Int32).Load())
+		}
+		return true
+	})
+
+	costs := map[string]*pb.CustomCost{}
+	for _, cost := range resp.Costs {
+		costs[cost.Id] = cost
+	}
+	expected := map[string]struct {
+		labels map[string]string
+		billed float32
+	}{
+		"record/agent_host_count/team=web,service=api": {map[string]string{"team": "web", "service": "api"}, 3},
+		"record/agent_host_count/team=db":              {map[string]string{"team": "db"}, 1},
+		"record/container_count_excl_agent/team=web":   {map[string]string{"team": "web"}, 1},
+		"record/container_count_excl_agent/untagged":   {map[string]string{}, 4},
+		// dbm hosts are left whole, since there's no usage attributed to tags for them
+		"record/dbm_host_count": {map[string]string{}, 0.5},
+	}
+	if len(costs) != len(expected) {
+		t.Fatalf("expected %d costs, got %v", len(expected), resp.Costs)
+	}
+	// split costs are in the order of their tag values
+	var hostIds []string
+	for _, cost := range resp.Costs {
+		if strings.HasPrefix(cost.Id, "record/agent_host_count/") {
+			hostIds = append(hostIds, cost.Id)
+		}
+	}
+	if len(hostIds) != 2 || hostIds[0] != "record/agent_host_count/team=db" {
+		t.Errorf("expected host costs to be sorted by tag values, got %v", hostIds)
+	}
+	for id, want := range expected {
+		cost, found := costs[id]
+		if !found {
+			t.Errorf("no cost with id %s in %v", id, resp.Costs)
+			continue
+		}
+		if math.Abs(float64(cost.BilledCost-want.billed)) > 1e-5 {
+			t.Errorf("expected cost %s to be billed %f, got %f", id, want.billed, cost.BilledCost)
+		}
+		if len(cost.Labels) != len(want.labels) {
+			t.Errorf("expected cost %s to have labels %v, got %v", id, want.labels, cost.Labels)
+		}
+		for key, value := range want.labels {
+			if cost.Labels[key] != value {
+				t.Errorf("expected cost %s to have labels %v, got %v", id, want.labels, cost.Labels)
+			}
+		}
+	}
+}
+
+func TestGetCustomCostsMultipleOrgs(t *testing.T) {
+	pricingAPI := &fakePricingAPI{}
+	mux := http.NewServeMux()
+	pricingAPI.register(mux)
+	mux.HandleFunc("/api/v2/usage/hourly_usage", func(w http.ResponseWriter, r *http.Request) {
+		record := func(id, orgName, publicId string, hosts float64) map[string]any {
+			return map[string]any{
+				"id":   id,
+				"type": "usage_timeseries",
+				"attributes": map[string]any{
+					"org_name":       orgName,
+					"public_id":      publicId,
+					"region":         "us",
+					"product_family": "infra_hosts",
+					"measurements":   []map[string]any{{"usage_type": "agent_host_count", "value": hosts}},
+				},
+			}
+		}
+		includeChildOrgs := r.URL.Query().Get("filter[include_descendants]") == "true"
+		var data []map[string]any
+		switch key := r.Header.Get("DD-API-KEY"); {
+		case key == "api-key" && includeChildOrgs:
+			data = []map[string]any{record("parent-record", "org", "public", 10), record("child-record", "child", "child-public", 20)}
+		case key == "other-api-key" && !includeChildOrgs:
+			data = []map[string]any{record("other-record", "other", "other-public", 30)}
+		default:
+			t.Errorf("unexpected hourly usage request with key %q for child orgs %t", key, includeChildOrgs)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+	ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{
+		IncludeChildOrgs: true,
+		Orgs: []datadogplugin.DatadogOrg{
+			{DDSite: "datadoghq.eu", DDAPIKey: "other-api-key", DDAppKey: "other-app-key"},
+		},
+	}, mux)
+
+	windowStart := time.Now().UTC().Add(-4 * 24 * time.Hour).Truncate(24 * time.Hour)
+	windowEnd := windowStart.Add(time.Hour)
+	resp, err := ddCostSrc.getCostsForWindow(context.Background(), opencost.NewWindow(&windowStart, &windowEnd))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+
+	expected := map[string]struct {
+		accountId, subAccountId, subAccountName string
+		billed                                  float32
+	}{
+		"parent-record/agent_host_count": {"public", "public", "org", 0.1},
+		"child-record/agent_host_count":  {"public", "child-public", "child", 0.2},
+		"other-record/agent_host_count":  {"public", "other-public", "other", 0.3},
+	}
+	if len(resp.Costs) != len(expected) {
+		t.Fatalf("expected %d costs, got %v", len(expected), resp.Costs)
+	}
+	for _, cost := range resp.Costs {
+		want, found := expected[cost.Id]
+		if !found {
+			t.Errorf("unexpected cost %v", cost)
+			continue
+		}
+		attrs := cost.ExtendedAttributes
+		if attrs.GetAccountId() != want.accountId || attrs.GetSubAccountId() != want.subAccountId || attrs.GetSubAccountName() != want.subAccountName {
+			t.Errorf("expected cost %s to have account %s and sub account %s (%s), got %v", cost.Id, want.accountId, want.subAccountId, want.subAccountName, attrs)
+		}
+		if math.Abs(float64(cost.BilledCost-want.billed)) > 1e-6 {
+			t.Errorf("expected cost %s to be billed %f, got %f", cost.Id, want.billed, cost.BilledCost)
+		}
+	}
+
+	// each org's unit prices are fetched with its own keys
+	if pricingAPI.billableSummaryCalls.Load() != 2 {
+		t.Errorf("expected unit prices to be fetched once per org, got %d billable summary calls", pricingAPI.billableSummaryCalls.Load())
+	}
+	if resp.Metadata["pricing_month"] != windowStart.Format("2006-01") || resp.Metadata[cache.StatusMetadataKey] != cache.StatusEstimated {
+		t.Errorf("unexpected metadata %v", resp.Metadata)
+	}
+}
+
+func TestGetDDCostsForWindowUsageFilter(t *testing.T) {
+	usage := map[string]float64{
+		"agent_host_count":           10,
+		"container_count_excl_agent": 500,
+		"unknown_count":              3,
+	}
+	derived := map[string]billableCost{
+		"infra_host":      {ProductName: "infra_host", Cost: 0.1},
+		"infra_container": {ProductName: "infra_container", Cost: 0.01},
+	}
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	usageHandler := hourlyUsageHandler(usage)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/usage/hourly_usage", func(w http.ResponseWriter, r *http.Request) {
+		if families := r.URL.Query().Get("filter[product_families]"); families != "infra_hosts,logs" {
+			t.Errorf("expected only the included product families to be queried, got %q", families)
+		}
+		usageHandler.ServeHTTP(w, r)
+	})
+	ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{
+		UsageFilter: datadogplugin.UsageFilter{
+			IncludeProductFamilies: []string{"infra_hosts", "logs"},
+			ExcludeUsageTypes:      []string{"container_count_excl_agent", "infra_hosts/unknown_count"},
+		},
+	}, mux)
+
+	resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, &monthUnitPrices{costs: derived})
+	if len(resp.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	if len(resp.Costs) != 1 || resp.Costs[0].ResourceName != "agent_host_count" {
+		t.Errorf("expected only agent hosts to be priced, got %v", resp.Costs)
+	}
+	// filtered out usage types aren't reported as unmapped
+	if unmapped, found := resp.Metadata["unmapped_usage_types"]; found {
+		t.Errorf("unexpected unmapped usage types %s", unmapped)
+	}
+}
+
+func TestGetDDCostsForWindowReconciliation(t *testing.T) {
+	month := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	costsEnd := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	windowEnd := costsEnd.Add(time.Hour)
+	window := opencost.NewWindow(&costsEnd, &windowEnd)
+
+	for _, mode := range []string{datadogplugin.ReconciliationTrueUp, datadogplugin.ReconciliationAdjustment} {
+		t.Run(mode, func(t *testing.T) {
+			mux := http.NewServeMux()
+			// the month so far and the window are both served 8000 host-hours
+			mux.Handle("/api/v2/usage/hourly_usage", hourlyUsageHandler(map[string]float64{"agent_host_count": 8000}))
+			ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{Reconciliation: mode}, mux)
+
+			prices := &monthUnitPrices{
+				month:    month,
+				costsEnd: costsEnd,
+				costs:    map[string]billableCost{"infra_host": {ProductName: "infra_host", Cost: 0.01}},
+				// the plugin prices the month's hosts at $80, and has no logs
+				totals: map[string]float64{"infra_host": 73, "logs_ingested": 5},
+			}
+			prices.reconciliation = ddCostSrc.reconcileMonth(context.Background(), ddCostSrc.orgs[0], prices)
+			if prices.reconciliation.err != nil {
+				t.Fatalf("unexpected error reconciling: %v", prices.reconciliation.err)
+			}
+
+			resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, prices)
+			if len(resp.Errors) != 0 {
+				t.Fatalf("unexpected errors: %v", resp.Errors)
+			}
+			if drift := resp.Metadata["reconciliation_drift"]; drift != "infra_host=+9.59%" {
+				t.Errorf("unexpected drift %q", drift)
+			}
+			if unreconciled := resp.Metadata["unreconciled_billing_dimensions"]; unreconciled != "logs_ingested" {
+				t.Errorf("unexpected unreconciled billing dimensions %q", unreconciled)
+			}
+
+			costs := map[string]*pb.CustomCost{}
+			for _, cost := range resp.Costs {
+				costs[cost.Id] = cost
+			}
+			hosts := costs["record/agent_host_count"]
+			if hosts == nil {
+				t.Fatalf("no host cost in %v", resp.Costs)
+			}
+			switch mode {
+			case datadogplugin.ReconciliationTrueUp:
+				if len(costs) != 1 || math.Abs(float64(hosts.BilledCost-73)) > 1e-3 {
+					t.Errorf("expected hosts to be billed $73, got %v", resp.Costs)
+				}
+			case datadogplugin.ReconciliationAdjustment:
+				adjustment := costs["public/reconciliation/infra_host"]
+				if len(costs) != 2 || math.Abs(float64(hosts.BilledCost-80)) > 1e-3 || adjustment == nil {
+					t.Fatalf("expected hosts billed $80 and an adjustment, got %v", resp.Costs)
+				}
+				if adjustment.ChargeCategory != "Adjustment" || math.Abs(float64(adjustment.BilledCost+7)) > 1e-3 || adjustment.ExtendedAttributes.GetSubAccountId() != "public" {
+					t.Errorf("expected a -$7 adjustment, got %v", adjustment)
+				}
+			}
+			if math.Abs(float64(hosts.ListCost-8000*18.0/730)) > 1e-2 {
+				t.Errorf("expected list cost to be left as is, got %f", hosts.ListCost)
+			}
+		})
+	}
+}
+
+func TestGetMonthlyChargesUsageFilter(t *testing.T) {
+	month := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name             string
+		filter           datadogplugin.UsageFilter
+		expectedFamilies string
+	}{
+		{name: "unfiltered", expectedFamilies: "dbm,infra_hosts"},
+		{name: "included", filter: datadogplugin.UsageFilter{IncludeProductFamilies: []string{"dbm", "logs"}}, expectedFamilies: "dbm"},
+		{name: "excluded", filter: datadogplugin.UsageFilter{ExcludeProductFamilies: []string{"dbm", "infra_hosts"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queried []string
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v2/usage/hourly_usage", func(w http.ResponseWriter, r *http.Request) {
+				queried = append(queried, r.URL.Query().Get("filter[product_families]"))
+				json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{}})
+			})
+			ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{UsageFilter: tt.filter}, mux)
+
+			if _, _, err := ddCostSrc.getMonthlyCharges(context.Background(), ddCostSrc.orgs[0], &monthUnitPrices{month: month}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expectedFamilies == "" && len(queried) != 0 {
+				t.Errorf("expected no hourly usage to be queried, got %v", queried)
+			}
+			if tt.expectedFamilies != "" && (len(queried) == 0 || queried[0] != tt.expectedFamilies) {
+				t.Errorf("expected %s to be queried, got %v", tt.expectedFamilies, queried)
+			}
+		})
+	}
+}
+
+func TestReconcileCostsAboveListPrice(t *testing.T) {
+	ddCostSrc := &DatadogCostSource{reconciliation: datadogplugin.ReconciliationTrueUp}
+	ccResp := &pb.CustomCostResponse{
+		Metadata: map[string]string{},
+		Costs: []*pb.CustomCost{{
+			Id:             "record/agent_host_count",
+			ProviderId:     "record/agent_host_count",
+			ChargeCategory: "Usage",
+			BilledCost:     10,
+			ListCost:       12,
+		}},
+	}
+	usageMappings := map[string]datadogplugin.UsageTypeMapping{"record/agent_host_count": {BillingDimension: "infra_host"}}
+
+	// Datadog charges half as much again as the plugin's billed costs
+	ddCostSrc.reconcileCosts(ccResp, usageMappings, &monthReconciliation{factors: map[string]float64{"infra_host": 1.5}})
+	cost := ccResp.Costs[0]
+	if cost.BilledCost != 15 || cost.ListCost != 15 {
+		t.Errorf("expected list cost to be raised to the billed $15, got %v", cost)
+	}
+	if err := validation.ValidateCost(cost); err != nil {
+		t.Errorf("invalid reconciled cost: %v", err)
+	}
+}
+
+func TestGetDDCostsForWindowMonthlyBilling(t *testing.T) {
+	month := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := month.AddDate(0, 1, 0)
+	spike := month.Add(100 * time.Hour)
+
+	mux := http.NewServeMux()
+	// 10 hosts every hour of the month, but for a spike to 50 hosts
+	mux.HandleFunc("/api/v2/usage/hourly_usage", func(w http.ResponseWriter, r *http.Request) {
+		start, err := time.Parse(time.RFC3339, r.URL.Query().Get("filter[timestamp][start]"))
+		if err != nil {
+			t.Fatalf("error parsing start: %v", err)
+		}
+		end, err := time.Parse(time.RFC3339, r.URL.Query().Get("filter[timestamp][end]"))
+		if err != nil {
+			t.Fatalf("error parsing end: %v", err)
+		}
+		data := []map[string]any{}
+		for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+			hosts := 10
+			if hour.Equal(spike) {
+				hosts = 50
+			}
+			data = append(data, map[string]any{
+				"id":   "record-" + hour.Format(time.RFC3339),
+				"type": "usage_timeseries",
+				"attributes": map[string]any{
+					"org_name":       "org",
+					"public_id":      "public",
+					"region":         "us",
+					"product_family": "infra_hosts",
+					"timestamp":      hour,
+					"measurements":   []map[string]any{{"usage_type": "agent_host_count", "value": hosts}},
+				},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	})
+	ddCostSrc := newTestCostSource(t, datadogplugin.DatadogConfig{}, mux)
+
+	prices := &monthUnitPrices{
+		month: month,
+		costs: map[string]billableCost{"infra_host": {ProductName: "infra_host", Cost: 0.02}},
+	}
+	var err error
+	prices.monthlyCharges, prices.chargesEnd, err = ddCostSrc.getMonthlyCharges(context.Background(), ddCostSrc.orgs[0], prices)
+	if err != nil {
+		t.Fatalf("unexpected error getting monthly charges: %v", err)
+	}
+
+	// the spike is above the 99th percentile, so the month is billed for 10
+	// hosts, and the daily costs add up to it
+	var billed, list float64
+	for start := month; start.Before(monthEnd); start = start.Add(24 * time.Hour) {
+		end := start.Add(24 * time.Hour)
+		resp := ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], opencost.NewWindow(&start, &end), prices)
+		if len(resp.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		if resp.Metadata["monthly_billed_dimensions"] != "infra_host" {
+			t.Errorf("expected hosts to be billed monthly, got %v", resp.Metadata)
+		}
+		for _, cost := range resp.Costs {
+			billed += float64(cost.BilledCost)
+			list += float64(cost.ListCost)
+		}
+	}
+	if math.Abs(billed-10*hoursPerMonth*0.02) > 1e-2 {
+		t.Errorf("expected the month to be billed $146, got %f", billed)
+	}
+	if math.Abs(list-10*18) > 1e-2 {
+		t.Errorf("expected the month to be listed at $180, got %f", list)
+	}
+
+	// charges computed from the first 10 days are computed again for the
+	// windows after them, so the month still adds up to its charge
+	tenDays := month.AddDate(0, 0, 10)
+	stale := &monthUnitPrices{
+		month: month,
+		costs: prices.costs,
+		monthlyCharges: map[string]monthlyCharge{
+			"infra_host": {billable: 10 * hoursPerMonth / 3, used: 10*240 + 40, monthShare: 1.0 / 3},
+		},
+		chargesEnd: tenDays,
+	}
+	if _, err := ddCostSrc.orgs[0].unitPrices.get(context.Background(), month, func() (*monthUnitPrices, error) { return stale, nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	billed = 0
+	for start := month; start.Before(monthEnd); start = start.Add(24 * time.Hour) {
+		end := start.Add(24 * time.Hour)
+		window := opencost.NewWindow(&start, &end)
+		cached, err := ddCostSrc.orgs[0].unitPrices.get(context.Background(), month, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		windowPrices, err := ddCostSrc.coverMonthlyCharges(context.Background(), ddCostSrc.orgs[0], cached, window)
+		if err != nil {
+			t.Fatalf("unexpected error covering monthly charges: %v", err)
+		}
+		if start.Before(tenDays) != (windowPrices == stale) {
+			t.Errorf("expected only windows after %s to get new charges, got charges until %s for %s", tenDays, windowPrices.chargesEnd, start)
+		}
+		for _, cost := range ddCostSrc.getDDCostsForWindow(context.Background(), ddCostSrc.orgs[0], window, windowPrices).Costs {
+			billed += float64(cost.BilledCost)
+		}
+	}
+	if cached, _ := ddCostSrc.orgs[0].unitPrices.get(context.Background(), month, nil); !cached.chargesEnd.Equal(monthEnd) {
+		t.Errorf("expected the new charges to be cached, got charges until %s", cached.chargesEnd)
+	}
+	// the first 10 days are billed all of the charges until then, and the
+	// rest of the month the share of the month's charges its usage makes up
+	if expected := 10*hoursPerMonth*0.02/3 + 10*hoursPerMonth*0.02*(10*480)/(10*720+40); math.Abs(billed-expected) > 1e-2 {
+		t.Errorf("expected the month to be billed $%f, got %f", expected, billed)
+	}
+}
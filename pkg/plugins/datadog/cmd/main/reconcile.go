@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	datadogplugin "github.com/opencost/opencost-plugins/pkg/plugins/datadog/datadogplugin"
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"google.golang.org/protobuf/proto"
+)
+
+// monthReconciliation compares the billed costs the plugin prices a billing
+// month's usage at with Datadog's costs for the month.
+type monthReconciliation struct {
+	// factors are Datadog's cost of each billing dimension over the plugin's
+	factors map[string]float64
+	// unreconciled are the billing dimensions Datadog charges for that the
+	// plugin has no costs for, e.g. because their usage types aren't mapped
+	unreconciled map[string]bool
+	// err is set when the plugin's costs for the month couldn't be fetched
+	err error
+}
+
+// reconcileMonth prices org's usage over the part of the month Datadog's
+// costs in prices cover, and compares it with those costs.
+func (d *DatadogCostSource) reconcileMonth(ctx context.Context, org *ddOrg, prices *monthUnitPrices) *monthReconciliation {
+	reconciliation := &monthReconciliation{
+		factors:      map[string]float64{},
+		unreconciled: map[string]bool{},
+	}
+	window := opencost.NewWindow(&prices.month, &prices.costsEnd)
+	resp, usageMappings := d.getPricedCosts(ctx, org, window, prices)
+	if len(resp.Errors) > 0 {
+		reconciliation.err = fmt.Errorf("error getting costs of %s so far to reconcile: %s", prices.month.Format("2006-01"), strings.Join(resp.Errors, "; "))
+		return reconciliation
+	}
+
+	billed := map[string]float64{}
+	for _, cost := range resp.Costs {
+		billed[usageMappings[cost.ProviderId].BillingDimension] += float64(cost.BilledCost)
+	}
+	for billingDimension, total := range prices.totals {
+		if total == 0 {
+			continue
+		}
+		if billed[billingDimension] == 0 {
+			reconciliation.unreconciled[billingDimension] = true
+			continue
+		}
+		reconciliation.factors[billingDimension] = total / billed[billingDimension]
+		log.Debugf("%s of %s billed %f against Datadog's %f", billingDimension, prices.month.Format("2006-01"), billed[billingDimension], total)
+	}
+	return reconciliation
+}
+
+// reconcileCosts corrects the billed costs in ccResp by the factors of
+// reconciliation, and records how far they drifted from Datadog's in its
+// metadata. Costs are either scaled, or left as they are with an adjustment
+// cost added for each org and billing dimension.
+func (d *DatadogCostSource) reconcileCosts(ccResp *pb.CustomCostResponse, usageMappings map[string]datadogplugin.UsageTypeMapping, reconciliation *monthReconciliation) {
+	if reconciliation.err != nil {
+		ccResp.Errors = append(ccResp.Errors, reconciliation.err.Error())
+		return
+	}
+
+	// drift is how far the plugin's costs are above or below Datadog's
+	drift := map[string]bool{}
+	for billingDimension, factor := range reconciliation.factors {
+		drift[fmt.Sprintf("%s=%+.2f%%", billingDimension, (1/factor-1)*100)] = true
+	}
+	if len(drift) > 0 {
+		ccResp.Metadata["reconciliation_drift"] = joinSorted(drift)
+	}
+	if len(reconciliation.unreconciled) > 0 {
+		ccResp.Metadata["unreconciled_billing_dimensions"] = joinSorted(reconciliation.unreconciled)
+	}
+
+	adjustments := map[string]*pb.CustomCost{}
+	for _, cost := range ccResp.Costs {
+		billingDimension := usageMappings[cost.ProviderId].BillingDimension
+		factor, found := reconciliation.factors[billingDimension]
+		if !found {
+			continue
+		}
+		if d.reconciliation == datadogplugin.ReconciliationTrueUp {
+			// list costs are public prices, so they're only raised to what
+			// Datadog charges above them
+			cost.BilledCost = float32(float64(cost.BilledCost) * factor)
+			cost.ListCost = max(cost.ListCost, cost.BilledCost)
+			continue
+		}
+
+		subAccountId := cost.ExtendedAttributes.GetSubAccountId()
+		key := subAccountId + "/reconciliation/" + billingDimension
+		if _, found := adjustments[key]; !found {
+			adjustments[key] = &pb.CustomCost{
+				Zone:               cost.Zone,
+				AccountName:        cost.AccountName,
+				ChargeCategory:     "Adjustment",
+				Description:        "reconciliation with Datadog's costs for the month so far",
+				ResourceName:       "reconciliation/" + billingDimension,
+				ResourceType:       "reconciliation",
+				Id:                 key,
+				ProviderId:         key,
+				Labels:             map[string]string{},
+				ExtendedAttributes: proto.Clone(cost.ExtendedAttributes).(*pb.CustomCostExtendedAttributes),
+			}
+			adjustments[key].ExtendedAttributes.PricingQuantity = nil
+			adjustments[key].ExtendedAttributes.PricingUnit = nil
+		}
+		adjustments[key].BilledCost += float32(float64(cost.BilledCost) * (factor - 1))
+	}
+
+	keys := make([]string, 0, len(adjustments))
+	for key := range adjustments {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if adjustments[key].BilledCost != 0 {
+			ccResp.Costs = append(ccResp.Costs, adjustments[key])
+		}
+	}
+}
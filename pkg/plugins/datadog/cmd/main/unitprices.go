@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opencost/opencost/core/pkg/log"
+)
+
+// unitPriceCache holds the unit prices of each billing month for ttl, or for
+// good once they're final, so windows in the same month share one set of
+// pricing calls, and calls made at the same time for a month wait for the
+// same fetch.
+type unitPriceCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[time.Time]*unitPriceEntry
+}
+
+type unitPriceEntry struct {
+	// ready is closed once prices, err and fetched are set
+	ready   chan struct{}
+	prices  *monthUnitPrices
+	err     error
+	fetched time.Time
+}
+
+func newUnitPriceCache(ttl time.Duration) *unitPriceCache {
+	return &unitPriceCache{
+		ttl:     ttl,
+		entries: map[time.Time]*unitPriceEntry{},
+	}
+}
+
+// get returns the unit prices of month, calling fetch if they aren't cached
+// or have expired. Errors, and prices whose reconciliation failed, aren't
+// cached.
+func (c *unitPriceCache) get(ctx context.Context, month time.Time, fetch func() (*monthUnitPrices, error)) (*monthUnitPrices, error) {
+	c.mu.Lock()
+	entry, found := c.entries[month]
+	if found {
+		select {
+		case <-entry.ready:
+			if entry.prices != nil && !entry.prices.final && time.Since(entry.fetched) >= c.ttl {
+				found = false
+			}
+		default:
+			// another window is fetching the prices
+		}
+	}
+	if !found {
+		entry = &unitPriceEntry{ready: make(chan struct{})}
+		c.entries[month] = entry
+		c.mu.Unlock()
+
+		prices, err := fetch()
+		c.mu.Lock()
+		entry.prices, entry.err, entry.fetched = prices, err, time.Now()
+		if (err != nil || !prices.cacheable()) && c.entries[month] == entry {
+			delete(c.entries, month)
+		}
+		c.mu.Unlock()
+		close(entry.ready)
+		return prices, err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		log.Debugf("using cached unit prices for %s", month.Format("2006-01"))
+		// the prices may have been replaced since they were fetched
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return entry.prices, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// replace caches updated as the unit prices of month in place of prices, if
+// those are still cached, without extending how long they're cached for.
+func (c *unitPriceCache) replace(month time.Time, prices, updated *monthUnitPrices) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, found := c.entries[month]; found && entry.prices == prices {
+		entry.prices = updated
+	}
+}
+
+// cacheable reports whether the prices can be cached. Prices whose
+// reconciliation failed aren't, so reconciliation is retried by the next
+// window rather than left off until they expire.
+func (p *monthUnitPrices) cacheable() bool {
+	return p.reconciliation == nil || p.reconciliation.err == nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnitPriceCache(t *testing.T) {
+	october := time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC)
+	november := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	var fetches atomic.Int32
+	fetch := func() (*monthUnitPrices, error) {
+		fetches.Add(1)
+		return &monthUnitPrices{costs: map[string]billableCost{"infra_host": {Cost: 1}}}, nil
+	}
+
+	t.Run("shared within a month", func(t *testing.T) {
+		fetches.Store(0)
+		c := newUnitPriceCache(time.Hour)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				prices, err := c.get(context.Background(), october, func() (*monthUnitPrices, error) {
+					time.Sleep(10 * time.Millisecond)
+					return fetch()
+				})
+				if err != nil || prices.costs["infra_host"].Cost != 1 {
+					t.Errorf("unexpected prices %v, error %v", prices, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if _, err := c.get(context.Background(), november, fetch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fetches.Load() != 2 {
+			t.Errorf("expected one fetch per month, got %d", fetches.Load())
+		}
+	})
+
+	t.Run("expires after ttl", func(t *testing.T) {
+		fetches.Store(0)
+		c := newUnitPriceCache(0)
+		for i := 0; i < 2; i++ {
+			if _, err := c.get(context.Background(), october, fetch); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if fetches.Load() != 2 {
+			t.Errorf("expected expired prices to be fetched again, got %d fetches", fetches.Load())
+		}
+	})
+
+	t.Run("final prices do not expire", func(t *testing.T) {
+		fetches.Store(0)
+		c := newUnitPriceCache(0)
+		for i := 0; i < 2; i++ {
+			_, err := c.get(context.Background(), october, func() (*monthUnitPrices, error) {
+				fetches.Add(1)
+				return &monthUnitPrices{final: true}, nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if fetches.Load() != 1 {
+			t.Errorf("expected final prices to be fetched once, got %d fetches", fetches.Load())
+		}
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		fetches.Store(0)
+		c := newUnitPriceCache(time.Hour)
+		_, err := c.get(context.Background(), october, func() (*monthUnitPrices, error) {
+			return nil, fmt.Errorf("boom")
+		})
+		if err == nil {
+			t.Fatalf("expected an error, but got none")
+		}
+		if _, err := c.get(context.Background(), october, fetch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if fetches.Load() != 1 {
+			t.Errorf("expected prices to be fetched after an error, got %d fetches", fetches.Load())
+		}
+	})
+	t.Run("failed reconciliations are not cached", func(t *testing.T) {
+		fetches.Store(0)
+		c := newUnitPriceCache(time.Hour)
+		for i := 0; i < 2; i++ {
+			prices, err := c.get(context.Background(), october, func() (*monthUnitPrices, error) {
+				fetches.Add(1)
+				return &monthUnitPrices{reconciliation: &monthReconciliation{err: fmt.Errorf("boom")}}, nil
+			})
+			if err != nil || prices.reconciliation.err == nil {
+				t.Fatalf("expected the prices with the failed reconciliation, got %v, error %v", prices, err)
+			}
+		}
+		if fetches.Load() != 2 {
+			t.Errorf("expected prices to be fetched again after a failed reconciliation, got %d fetches", fetches.Load())
+		}
+	})
+}
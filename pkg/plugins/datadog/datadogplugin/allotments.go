@@ -0,0 +1,60 @@
+package datadog
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed allotments.json
+var defaultAllotments []byte
+
+// Allotments are the usage Datadog includes for free with other usage, e.g.
+// the normalized queries included with each DBM host.
+type Allotments struct {
+	Version string `json:"version"`
+	// Allotments is keyed by the usage type that is included, named as in the
+	// usage mapping.
+	Allotments map[string]Allotment `json:"allotments"`
+}
+
+// Allotment is the usage of a usage type included with another usage type.
+type Allotment struct {
+	// GrantedBy is the usage type the allotment comes with
+	GrantedBy string `json:"granted_by"`
+	// Quantity is how many units of usage are included with Per units of the
+	// GrantedBy usage, e.g. 200 queries per DBM host-hour, or 150000000000
+	// bytes per 730 APM host-hours for 150 GB per host each month. A quantity
+	// of 0 disables the allotment.
+	Quantity float64 `json:"quantity"`
+	// Per defaults to 1
+	Per float64 `json:"per"`
+}
+
+// Included returns how many units of usage are included with grantedBy units
+// of the GrantedBy usage.
+func (a Allotment) Included(grantedBy float64) float64 {
+	return grantedBy * a.Quantity / unitsPerRate(a.Per)
+}
+
+// LoadAllotments returns the allotments embedded in the plugin with the usage
+// types in overrides replacing or adding to its allotments.
+func LoadAllotments(overrides Allotments) (*Allotments, error) {
+	var allotments Allotments
+	if err := json.Unmarshal(defaultAllotments, &allotments); err != nil {
+		return nil, fmt.Errorf("error parsing embedded allotments: %v", err)
+	}
+	if len(overrides.Allotments) == 0 {
+		return &allotments, nil
+	}
+
+	overridesVersion := overrides.Version
+	if overridesVersion == "" {
+		overridesVersion = "custom"
+	}
+	allotments.Version += "+" + overridesVersion
+	for usageType, allotment := range overrides.Allotments {
+		allotments.Allotments[usageType] = allotment
+	}
+	return &allotments, nil
+}
@@ -0,0 +1,36 @@
+package datadog
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLoadAllotments(t *testing.T) {
+	allotments, err := LoadAllotments(Allotments{})
+	if err != nil {
+		t.Fatalf("error loading embedded allotments: %v", err)
+	}
+	if allotments.Version == "" {
+		t.Errorf("embedded allotments have no version")
+	}
+	if included := allotments.Allotments["dbm_queries_count"].Included(3); included != 600 {
+		t.Errorf("expected 200 queries per dbm host, got %f for 3 hosts", included)
+	}
+	// a month of one apm host includes 150 GB of ingested spans
+	if included := allotments.Allotments["ingested_spans/ingested_events_bytes"].Included(730); math.Abs(included-150e9) > 1 {
+		t.Errorf("expected 150 GB of spans per apm host each month, got %f", included)
+	}
+
+	overridden, err := LoadAllotments(Allotments{
+		Allotments: map[string]Allotment{"container_count_excl_agent": {GrantedBy: "agent_host_count", Quantity: 10}},
+	})
+	if err != nil {
+		t.Fatalf("error loading overridden allotments: %v", err)
+	}
+	if overridden.Version != allotments.Version+"+custom" {
+		t.Errorf("unexpected overridden version %q", overridden.Version)
+	}
+	if included := overridden.Allotments["container_count_excl_agent"].Included(2); included != 20 {
+		t.Errorf("expected override to include 10 containers per host, got %f for 2 hosts", included)
+	}
+}
@@ -1,8 +1,89 @@
 package datadog
 
+import "github.com/opencost/opencost-plugins/common/sdk"
+
 type DatadogConfig struct {
-	DDSite     string `json:"datadog_site"`
-	DDAPIKey   string `json:"datadog_api_key"`
-	DDAppKey   string `json:"datadog_app_key"`
-	DDLogLevel string `json:"log_level"`
+	DDSite     string `json:"datadog_site" required:"true"`
+	DDAPIKey   string `json:"datadog_api_key" required:"true"`
+	DDAppKey   string `json:"datadog_app_key" required:"true"`
+	DDLogLevel string `json:"log_level" default:"info"`
+	// Mode is ModeImport, the default, to report Datadog's costs to OpenCost,
+	// or ModeExport to upload the costs of other plugins to Datadog Cloud Cost
+	// Management as custom costs with the export command instead
+	Mode string `json:"mode"`
+	// IncludeChildOrgs breaks costs out per child org when the keys above
+	// belong to a parent org
+	IncludeChildOrgs bool `json:"include_child_orgs"`
+	// Orgs are independent orgs, each with their own site and keys, whose
+	// costs are fetched along with those of the org above
+	Orgs []DatadogOrg `json:"orgs"`
+	// Config holds the caching, timeout, parallelism, metrics and tracing
+	// settings. Windows are only cached 72 hours after they end by default.
+	sdk.Config
+	// UnitPriceTTL is how long unit prices derived from Datadog's estimated
+	// costs are reused for before they're fetched again, e.g. "1h". They are
+	// shared by every window in the same billing month. The usage attributed
+	// to tags each day is reused for as long. Defaults to 6 hours.
+	UnitPriceTTL string `json:"unit_price_ttl"`
+	// UsageMapping adds to or replaces entries in the usage type to billing
+	// dimension mapping built into the plugin. Usage types that aren't mapped
+	// aren't priced, and are listed in the response metadata.
+	UsageMapping UsageMapping `json:"usage_mapping"`
+	// RateCard is the contract price of each billing dimension. Billed costs
+	// are computed from it, and only billing dimensions missing from it are
+	// billed at the price derived from Datadog's estimated costs.
+	RateCard map[string]ContractRate `json:"rate_card"`
+	// ListPrices adds to or replaces the public list prices built into the
+	// plugin, which list costs are computed from.
+	ListPrices ListPrices `json:"list_prices"`
+	// Allotments adds to or replaces the allotments built into the plugin, such
+	// as the normalized queries included with each DBM host. Only usage above
+	// the allotment is priced.
+	Allotments Allotments `json:"allotments"`
+	// AttributionTags enables splitting costs by these tag keys, e.g. "team" or
+	// "kube_namespace", in proportion to the usage Datadog attributes to each
+	// of their values. The tags must be configured for usage attribution in
+	// Datadog, which allows up to 3 of them.
+	AttributionTags []string `json:"attribution_tags"`
+	// UsageFilter limits the product families that are queried, and the usage
+	// types that are priced, e.g. to only report infra, logs and APM costs.
+	UsageFilter UsageFilter `json:"usage_filter"`
+	// Reconciliation enables comparing the costs of each billing dimension over
+	// the pricing month so far with Datadog's cost for it, and correcting for
+	// the difference, either by scaling costs with ReconciliationTrueUp, or by
+	// adding an adjustment cost per billing dimension with
+	// ReconciliationAdjustment. It's disabled by default.
+	Reconciliation string `json:"reconciliation"`
+}
+
+const (
+	ModeImport = "import"
+	ModeExport = "export"
+)
+
+const (
+	ReconciliationTrueUp     = "true_up"
+	ReconciliationAdjustment = "adjustment"
+)
+
+// DatadogOrg is a Datadog org costs are fetched from.
+type DatadogOrg struct {
+	DDSite   string `json:"datadog_site"`
+	DDAPIKey string `json:"datadog_api_key"`
+	DDAppKey string `json:"datadog_app_key"`
+	// IncludeChildOrgs breaks costs out per child org when the keys belong to
+	// a parent org
+	IncludeChildOrgs bool `json:"include_child_orgs"`
+}
+
+// AllOrgs returns the org the config's keys belong to followed by the
+// independent orgs in Orgs.
+func (c *DatadogConfig) AllOrgs() []DatadogOrg {
+	orgs := []DatadogOrg{{
+		DDSite:           c.DDSite,
+		DDAPIKey:         c.DDAPIKey,
+		DDAppKey:         c.DDAppKey,
+		IncludeChildOrgs: c.IncludeChildOrgs,
+	}}
+	return append(orgs, c.Orgs...)
 }
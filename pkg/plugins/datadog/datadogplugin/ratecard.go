@@ -0,0 +1,132 @@
+package datadog
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+//go:embed listprices.json
+var defaultListPrices []byte
+
+// ListPrices are Datadog's public on-demand prices, keyed by billing dimension.
+type ListPrices struct {
+	Version string               `json:"version"`
+	Prices  map[string]ListPrice `json:"prices"`
+}
+
+// ListPrice is the public price of a billing dimension.
+type ListPrice struct {
+	// Rate is the price of UnitsPerRate units of usage
+	Rate float64 `json:"rate"`
+	// UnitsPerRate is how many units of usage, as reported by the usage
+	// mapping, Rate is for, e.g. 730 host-hours for a monthly host price or
+	// 1000000000 bytes for a per GB price. Defaults to 1.
+	UnitsPerRate float64 `json:"units_per_rate"`
+	// BillingModel is how Datadog bills each month's usage of the billing
+	// dimension, one of the BillingModel constants. Defaults to
+	// BillingModelPerUnit.
+	BillingModel string `json:"billing_model,omitempty"`
+	// Percentile of hourly usage billed with BillingModelPercentile, e.g. 99
+	Percentile float64 `json:"percentile,omitempty"`
+	// ProductFamily is the product family with the hourly usage of monthly
+	// billed dimensions, so only it is queried for the month's usage. All
+	// product families are queried if it's empty.
+	ProductFamily string `json:"product_family,omitempty"`
+}
+
+const (
+	// BillingModelPerUnit bills every unit of usage, e.g. every GB of logs
+	BillingModelPerUnit = "per_unit"
+	// BillingModelPercentile bills a percentile of the month's hourly usage
+	// for the whole month, e.g. the 99th percentile of hosts
+	BillingModelPercentile = "percentile"
+	// BillingModelHighWaterMark bills the month's highest hourly usage for the
+	// whole month
+	BillingModelHighWaterMark = "high_water_mark"
+)
+
+// UnitPrice returns the price of a single unit of usage.
+func (p ListPrice) UnitPrice() float64 {
+	return p.Rate / unitsPerRate(p.UnitsPerRate)
+}
+
+// BilledMonthly reports whether usage of the billing dimension is billed from
+// the month's hourly usage as a whole, rather than per unit.
+func (p ListPrice) BilledMonthly() bool {
+	return p.BillingModel == BillingModelPercentile || p.BillingModel == BillingModelHighWaterMark
+}
+
+// MonthlyQuantity returns the quantity billed for the whole month with the
+// given hourly usage, with one value for every hour of the month so far,
+// including hours without usage. Datadog discards the hours above the
+// percentile and bills the highest of the rest.
+func (p ListPrice) MonthlyQuantity(hourly []float64) float64 {
+	if len(hourly) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, hourly...)
+	sort.Float64s(sorted)
+	if p.BillingModel != BillingModelPercentile {
+		return sorted[len(sorted)-1]
+	}
+	index := int(math.Ceil(float64(len(sorted))*p.Percentile/100)) - 1
+	return sorted[min(max(index, 0), len(sorted)-1)]
+}
+
+// LoadListPrices returns the list prices embedded in the plugin with the
+// billing dimensions in overrides replacing or adding to its prices.
+func LoadListPrices(overrides ListPrices) (*ListPrices, error) {
+	var prices ListPrices
+	if err := json.Unmarshal(defaultListPrices, &prices); err != nil {
+		return nil, fmt.Errorf("error parsing embedded list prices: %v", err)
+	}
+	if len(overrides.Prices) == 0 {
+		return &prices, nil
+	}
+
+	overridesVersion := overrides.Version
+	if overridesVersion == "" {
+		overridesVersion = "custom"
+	}
+	prices.Version += "+" + overridesVersion
+	for billingDimension, price := range overrides.Prices {
+		prices.Prices[billingDimension] = price
+	}
+	return &prices, nil
+}
+
+// ContractRate is the negotiated price of a billing dimension.
+type ContractRate struct {
+	// OnDemandRate is the price of UnitsPerRate units of usage above the
+	// commitment
+	OnDemandRate float64 `json:"on_demand_rate"`
+	// CommittedRate is the price of UnitsPerRate units of usage within the
+	// commitment
+	CommittedRate float64 `json:"committed_rate"`
+	// CommittedQuantity is how many UnitsPerRate units of usage are committed
+	// to each month, e.g. 50 for 50 hosts when UnitsPerRate is 730
+	CommittedQuantity float64 `json:"committed_quantity"`
+	// UnitsPerRate is how many units of usage, as reported by the usage
+	// mapping, the rates are for. Defaults to 1.
+	UnitsPerRate float64 `json:"units_per_rate"`
+}
+
+// Cost returns the price of quantity units of usage in a window that is
+// monthShare of its billing month. The window's share of the monthly
+// commitment is billed at the committed rate, and the rest at the on-demand
+// rate.
+func (r ContractRate) Cost(quantity, monthShare float64) float64 {
+	units := unitsPerRate(r.UnitsPerRate)
+	committed := min(quantity, r.CommittedQuantity*units*monthShare)
+	return (committed*r.CommittedRate + (quantity-committed)*r.OnDemandRate) / units
+}
+
+func unitsPerRate(units float64) float64 {
+	if units == 0 {
+		return 1
+	}
+	return units
+}
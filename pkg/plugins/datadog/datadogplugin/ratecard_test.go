@@ -0,0 +1,87 @@
+package datadog
+
+import (
+	"math"
+	"testing"
+)
+
+func TestContractRateCost(t *testing.T) {
+	rate := ContractRate{OnDemandRate: 15, CommittedRate: 10, CommittedQuantity: 5, UnitsPerRate: 730}
+
+	tests := []struct {
+		name       string
+		quantity   float64
+		monthShare float64
+		expected   float64
+	}{
+		{name: "within commitment", quantity: 730, monthShare: 0.5, expected: 10},
+		{name: "above commitment", quantity: 5 * 730, monthShare: 0.5, expected: 2.5*10 + 2.5*15},
+		{name: "no usage", quantity: 0, monthShare: 1, expected: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cost := rate.Cost(tt.quantity, tt.monthShare); math.Abs(cost-tt.expected) > 1e-9 {
+				t.Errorf("expected %f, got %f", tt.expected, cost)
+			}
+		})
+	}
+
+	onDemand := ContractRate{OnDemandRate: 0.5}
+	if cost := onDemand.Cost(4, 1); cost != 2 {
+		t.Errorf("expected rates per unit by default, got %f", cost)
+	}
+}
+
+func TestLoadListPrices(t *testing.T) {
+	prices, err := LoadListPrices(ListPrices{})
+	if err != nil {
+		t.Fatalf("error loading embedded list prices: %v", err)
+	}
+	if prices.Version == "" {
+		t.Errorf("embedded list prices have no version")
+	}
+	if unitPrice := prices.Prices["dbm_host"].UnitPrice(); math.Abs(unitPrice-84.0/730) > 1e-9 {
+		t.Errorf("unexpected dbm host unit price %f", unitPrice)
+	}
+
+	overridden, err := LoadListPrices(ListPrices{
+		Version: "2025",
+		Prices:  map[string]ListPrice{"dbm_host": {Rate: 0.2}},
+	})
+	if err != nil {
+		t.Fatalf("error loading overridden list prices: %v", err)
+	}
+	if overridden.Version != prices.Version+"+2025" {
+		t.Errorf("unexpected overridden version %q", overridden.Version)
+	}
+	if unitPrice := overridden.Prices["dbm_host"].UnitPrice(); unitPrice != 0.2 {
+		t.Errorf("expected override to replace the dbm host price, got %f", unitPrice)
+	}
+}
+
+func TestListPriceMonthlyQuantity(t *testing.T) {
+	// 100 hours with 10 hosts, and a spike to 50 hosts for one of them
+	hourly := make([]float64, 100)
+	for i := range hourly {
+		hourly[i] = 10
+	}
+	hourly[42] = 50
+
+	percentile := ListPrice{BillingModel: BillingModelPercentile, Percentile: 99}
+	if !percentile.BilledMonthly() {
+		t.Errorf("expected percentile billing to be monthly")
+	}
+	if quantity := percentile.MonthlyQuantity(hourly); quantity != 10 {
+		t.Errorf("expected the spike to be discarded, got %f", quantity)
+	}
+	highWaterMark := ListPrice{BillingModel: BillingModelHighWaterMark}
+	if quantity := highWaterMark.MonthlyQuantity(hourly); quantity != 50 {
+		t.Errorf("expected the spike to be billed, got %f", quantity)
+	}
+	if (ListPrice{}).BilledMonthly() {
+		t.Errorf("expected usage to be billed per unit by default")
+	}
+	if quantity := percentile.MonthlyQuantity(nil); quantity != 0 {
+		t.Errorf("expected no quantity without usage, got %f", quantity)
+	}
+}
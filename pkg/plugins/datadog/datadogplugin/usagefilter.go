@@ -0,0 +1,108 @@
+package datadog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UsageFilter limits the usage that is fetched and priced to some product
+// families and usage types. Usage types are named either on their own, e.g.
+// "agent_host_count", or with their product family, e.g.
+// "indexed_spans/indexed_events_count".
+type UsageFilter struct {
+	// IncludeProductFamilies are the only product families queried, if set,
+	// e.g. "infra_hosts", "logs" and "indexed_spans".
+	IncludeProductFamilies []string `json:"include_product_families"`
+	// ExcludeProductFamilies are product families that aren't queried, when no
+	// product families are included
+	ExcludeProductFamilies []string `json:"exclude_product_families"`
+	// IncludeUsageTypes are the only usage types kept, if set
+	IncludeUsageTypes []string `json:"include_usage_types"`
+	// ExcludeUsageTypes are usage types whose usage is dropped
+	ExcludeUsageTypes []string `json:"exclude_usage_types"`
+}
+
+// Validate returns an error if the filter includes and excludes the same
+// product family or usage type.
+func (f UsageFilter) Validate() error {
+	for _, family := range f.IncludeProductFamilies {
+		if contains(f.ExcludeProductFamilies, family) {
+			return fmt.Errorf("product family %s is both included and excluded", family)
+		}
+	}
+	for _, usageType := range f.IncludeUsageTypes {
+		if contains(f.ExcludeUsageTypes, usageType) {
+			return fmt.Errorf("usage type %s is both included and excluded", usageType)
+		}
+	}
+	return nil
+}
+
+// KnownProductFamilies are the product families the hourly usage API reports,
+// as listed in https://docs.datadoghq.com/api/latest/usage-metering/#get-hourly-usage-by-product-family.
+// Filters that only exclude product families query the rest of them.
+var KnownProductFamilies = []string{
+	"analyzed_logs", "application_security", "audit_trail", "ci_app",
+	"cloud_cost_management", "csm_container_enterprise", "csm_host_enterprise",
+	"cspm", "custom_events", "cws", "dbm", "error_tracking", "fargate",
+	"incident_management", "indexed_logs", "indexed_spans", "infra_hosts",
+	"ingested_spans", "iot", "lambda_traced_invocations", "logs",
+	"netflow_monitoring", "network_flows", "network_hosts",
+	"observability_pipelines", "online_archive", "profiling", "rum",
+	"rum_browser_sessions", "rum_mobile_sessions", "sds", "serverless", "snmp",
+	"software_delivery", "synthetics_api", "synthetics_browser",
+	"synthetics_mobile", "synthetics_parallel_testing_slots", "timeseries",
+	"vuln_management", "workflow_executions",
+}
+
+// ProductFamilies returns the product families to query hourly usage for, as
+// a comma separated list, or "all" when they aren't limited. When product
+// families are only excluded, the known product families other than those
+// are queried, so excluded usage isn't fetched.
+func (f UsageFilter) ProductFamilies() string {
+	if len(f.IncludeProductFamilies) > 0 {
+		return strings.Join(f.IncludeProductFamilies, ",")
+	}
+	if len(f.ExcludeProductFamilies) == 0 {
+		return "all"
+	}
+
+	var families []string
+	for _, family := range KnownProductFamilies {
+		if !contains(f.ExcludeProductFamilies, family) {
+			families = append(families, family)
+		}
+	}
+	return strings.Join(families, ",")
+}
+
+// IncludesProductFamily reports whether any usage in productFamily can pass
+// the filter.
+func (f UsageFilter) IncludesProductFamily(productFamily string) bool {
+	if len(f.IncludeProductFamilies) > 0 && !contains(f.IncludeProductFamilies, productFamily) {
+		return false
+	}
+	return !contains(f.ExcludeProductFamilies, productFamily)
+}
+
+// Includes reports whether usage of usageType in productFamily passes the
+// filter.
+func (f UsageFilter) Includes(productFamily, usageType string) bool {
+	if !f.IncludesProductFamily(productFamily) {
+		return false
+	}
+	qualified := productFamily + "/" + usageType
+	if len(f.IncludeUsageTypes) > 0 && !contains(f.IncludeUsageTypes, usageType) && !contains(f.IncludeUsageTypes, qualified) {
+		return false
+	}
+	return !contains(f.ExcludeUsageTypes, usageType) && !contains(f.ExcludeUsageTypes, qualified)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
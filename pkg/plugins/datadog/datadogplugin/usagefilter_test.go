@@ -0,0 +1,61 @@
+package datadog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsageFilter(t *testing.T) {
+	if families := (UsageFilter{}).ProductFamilies(); families != "all" {
+		t.Errorf("expected all product families without a filter, got %s", families)
+	}
+	if !(UsageFilter{}).Includes("logs", "indexed_events_count") {
+		t.Errorf("expected an empty filter to include everything")
+	}
+
+	filter := UsageFilter{
+		IncludeProductFamilies: []string{"infra_hosts", "logs", "indexed_spans"},
+		ExcludeUsageTypes:      []string{"logs_live_ingested_bytes", "indexed_spans/indexed_events_count"},
+	}
+	if err := filter.Validate(); err != nil {
+		t.Fatalf("unexpected error validating filter: %v", err)
+	}
+	if families := filter.ProductFamilies(); families != "infra_hosts,logs,indexed_spans" {
+		t.Errorf("unexpected product families %s", families)
+	}
+	tests := []struct {
+		productFamily, usageType string
+		included                 bool
+	}{
+		{"infra_hosts", "agent_host_count", true},
+		{"logs", "indexed_events_count", true},
+		{"logs", "logs_live_ingested_bytes", false},
+		{"indexed_spans", "indexed_events_count", false},
+		{"synthetics_api", "check_calls_count", false},
+	}
+	for _, tt := range tests {
+		if included := filter.Includes(tt.productFamily, tt.usageType); included != tt.included {
+			t.Errorf("expected %s/%s included to be %t", tt.productFamily, tt.usageType, tt.included)
+		}
+	}
+
+	filter = UsageFilter{
+		ExcludeProductFamilies: []string{"rum"},
+		IncludeUsageTypes:      []string{"agent_host_count", "logs/indexed_events_count"},
+	}
+	families := strings.Split(filter.ProductFamilies(), ",")
+	if len(families) != len(KnownProductFamilies)-1 || contains(families, "rum") || !contains(families, "infra_hosts") {
+		t.Errorf("expected every known product family but rum to be queried when only excluding it, got %v", families)
+	}
+	if !filter.Includes("infra_hosts", "agent_host_count") || !filter.Includes("logs", "indexed_events_count") {
+		t.Errorf("expected included usage types to be included")
+	}
+	if filter.Includes("indexed_spans", "indexed_events_count") || filter.Includes("rum", "agent_host_count") {
+		t.Errorf("expected usage types outside the filter to be excluded")
+	}
+
+	filter = UsageFilter{IncludeProductFamilies: []string{"logs"}, ExcludeProductFamilies: []string{"logs"}}
+	if err := filter.Validate(); err == nil {
+		t.Errorf("expected an error for a product family that is both included and excluded")
+	}
+}
@@ -0,0 +1,65 @@
+package datadog
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed usagemapping.json
+var defaultUsageMapping []byte
+
+// UsageMapping maps the usage types reported by the hourly usage API to the
+// billing dimensions Datadog prices them under.
+type UsageMapping struct {
+	Version string `json:"version"`
+	// UsageTypes is keyed by usage type, e.g. "agent_host_count", or by
+	// product family and usage type, e.g. "indexed_spans/indexed_events_count",
+	// for usage types that more than one product family reports.
+	UsageTypes map[string]UsageTypeMapping `json:"usage_types"`
+}
+
+// UsageTypeMapping is the billing dimension and unit of a single usage type.
+// Usage types with an empty billing dimension are known, but aren't billed on
+// their own, e.g. because another usage type already counts them.
+type UsageTypeMapping struct {
+	BillingDimension string `json:"billing_dimension"`
+	Unit             string `json:"unit"`
+	// AttributionUsageType is the usage type the hourly usage attribution API
+	// breaks this usage down by tag under, if it does.
+	AttributionUsageType string `json:"attribution_usage_type,omitempty"`
+}
+
+// LoadUsageMapping returns the mapping embedded in the plugin with the usage
+// types in overrides replacing or adding to its entries.
+func LoadUsageMapping(overrides UsageMapping) (*UsageMapping, error) {
+	var mapping UsageMapping
+	if err := json.Unmarshal(defaultUsageMapping, &mapping); err != nil {
+		return nil, fmt.Errorf("error parsing embedded usage mapping: %v", err)
+	}
+	if len(overrides.UsageTypes) == 0 {
+		return &mapping, nil
+	}
+
+	overridesVersion := overrides.Version
+	if overridesVersion == "" {
+		overridesVersion = "custom"
+	}
+	mapping.Version += "+" + overridesVersion
+	for usageType, usageMapping := range overrides.UsageTypes {
+		mapping.UsageTypes[usageType] = usageMapping
+	}
+	return &mapping, nil
+}
+
+// Lookup returns the mapping for usageType as reported by productFamily,
+// preferring an entry for the product family over one for the usage type
+// alone, and the key of the entry it used.
+func (m *UsageMapping) Lookup(productFamily, usageType string) (string, UsageTypeMapping, bool) {
+	key := productFamily + "/" + usageType
+	if usageMapping, ok := m.UsageTypes[key]; ok {
+		return key, usageMapping, true
+	}
+	usageMapping, ok := m.UsageTypes[usageType]
+	return usageType, usageMapping, ok
+}
@@ -0,0 +1,45 @@
+package datadog
+
+import "testing"
+
+func TestLoadUsageMapping(t *testing.T) {
+	mapping, err := LoadUsageMapping(UsageMapping{})
+	if err != nil {
+		t.Fatalf("error loading embedded usage mapping: %v", err)
+	}
+	if mapping.Version == "" {
+		t.Errorf("embedded usage mapping has no version")
+	}
+	for usageType, usageMapping := range mapping.UsageTypes {
+		if usageMapping.Unit == "" {
+			t.Errorf("usage type %s has no unit", usageType)
+		}
+	}
+
+	key, usageMapping, ok := mapping.Lookup("indexed_spans", "indexed_events_count")
+	if !ok || key != "indexed_spans/indexed_events_count" || usageMapping.BillingDimension != "indexed_spans" {
+		t.Errorf("expected the product family entry for indexed spans, got %s: %v", key, usageMapping)
+	}
+	key, usageMapping, ok = mapping.Lookup("logs", "indexed_events_count")
+	if !ok || key != "indexed_events_count" || usageMapping.BillingDimension != "logs_indexed_15day" {
+		t.Errorf("expected the usage type entry for indexed logs, got %s: %v", key, usageMapping)
+	}
+	if _, _, ok := mapping.Lookup("infra_hosts", "unknown_count"); ok {
+		t.Errorf("expected no entry for an unknown usage type")
+	}
+
+	overridden, err := LoadUsageMapping(UsageMapping{
+		UsageTypes: map[string]UsageTypeMapping{
+			"agent_host_count": {BillingDimension: "", Unit: "host-hours"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error loading overridden usage mapping: %v", err)
+	}
+	if overridden.Version != mapping.Version+"+custom" {
+		t.Errorf("unexpected overridden version %q", overridden.Version)
+	}
+	if _, usageMapping, _ := overridden.Lookup("infra_hosts", "agent_host_count"); usageMapping.BillingDimension != "" {
+		t.Errorf("expected override to replace the agent host mapping, got %v", usageMapping)
+	}
+}
@@ -1,36 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/hashicorp/go-plugin"
 	"github.com/icholy/digest"
 	commonconfig "github.com/opencost/opencost-plugins/common/config"
+	"github.com/opencost/opencost-plugins/common/httpclient"
+	"github.com/opencost/opencost-plugins/common/sdk"
 	atlasconfig "github.com/opencost/opencost-plugins/pkg/plugins/mongodb-atlas/config"
 	atlasplugin "github.com/opencost/opencost-plugins/pkg/plugins/mongodb-atlas/plugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
 	"github.com/opencost/opencost/core/pkg/opencost"
-	ocplugin "github.com/opencost/opencost/core/pkg/plugin"
 	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/apimachinery/pkg/util/uuid"
 )
 
-// handshakeConfigs are used to just do a basic handshake between
-// a plugin and host. If the handshake fails, a user friendly error is shown.
-// This prevents users from executing bad plugins or executing a plugin
-// directory. It is a UX feature, not a security feature.
-var handshakeConfig = plugin.HandshakeConfig{
-	ProtocolVersion:  1,
-	MagicCookieKey:   "PLUGIN_NAME",
-	MagicCookieValue: "mongodb-atlas",
-}
-
 const costExplorerPendingInvoicesURL = "https://cloud.mongodb.com/api/atlas/v2/orgs/%s/invoices/pending"
 
 func main() {
@@ -41,40 +33,58 @@ func main() {
 		log.Fatalf("error opening config file: %v", err)
 	}
 
-	atlasConfig, err := atlasconfig.GetAtlasConfig(configFile)
+	// as per https://www.mongodb.com/docs/atlas/api/atlas-admin-api-ref/,
+	// atlas admin APIs have a limit of 100 requests per minute. The limiter
+	// outlives config reloads, so rotating keys doesn't reset it.
+	rateLimiter := rate.NewLimiter(1.1, 2)
+	var atlasCostSrc sdk.SwappableSource
+	_, err = commonconfig.Watch(configFile, commonconfig.DefaultWatchInterval, func(atlasConfig *atlasconfig.AtlasConfig) error {
+		src, err := newAtlasCostSource(atlasConfig, rateLimiter)
+		if err != nil {
+			return err
+		}
+		if err := sdk.StartTelemetry("mongodb-atlas", atlasConfig.Config); err != nil {
+			return err
+		}
+		log.SetLogLevel(atlasConfig.LogLevel)
+		atlasCostSrc.Store(src)
+		return nil
+	})
 	if err != nil {
 		log.Fatalf("error building Atlas config: %v", err)
 	}
-	log.SetLogLevel(atlasConfig.LogLevel)
 
-	// as per https://www.mongodb.com/docs/atlas/api/atlas-admin-api-ref/,
-	// atlas admin APIs have a limit of 100 requests per minute
-	rateLimiter := rate.NewLimiter(1.1, 2)
-	atlasCostSrc := AtlasCostSource{
-		rateLimiter: rateLimiter,
-		orgID:       atlasConfig.OrgID,
-	}
-	atlasCostSrc.atlasClient = getAtlasClient(*atlasConfig)
+	sdk.Serve("mongodb-atlas", &atlasCostSrc)
+}
 
-	// pluginMap is the map of plugins we can dispense.
-	var pluginMap = map[string]plugin.Plugin{
-		"CustomCostSource": &ocplugin.CustomCostPlugin{Impl: &atlasCostSrc},
+// newAtlasCostSource builds a cost source with the credentials and settings
+// in atlasConfig. A new one is built every time the config is reloaded.
+func newAtlasCostSource(atlasConfig *atlasconfig.AtlasConfig, rateLimiter *rate.Limiter) (*AtlasCostSource, error) {
+	// line items on the pending invoice can still be adjusted for a couple of days
+	costSource, err := sdk.NewCostSource("mongodb-atlas", atlasConfig.Config, 48*time.Hour)
+	if err != nil {
+		return nil, err
 	}
 
-	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: handshakeConfig,
-		Plugins:         pluginMap,
-		GRPCServer:      plugin.DefaultGRPCServer,
-	})
-
+	return &AtlasCostSource{
+		rateLimiter: rateLimiter,
+		orgID:       atlasConfig.OrgID,
+		atlasClient: getAtlasClient(*atlasConfig, rateLimiter),
+		costSource:  costSource,
+	}, nil
 }
 
-func getAtlasClient(atlasConfig atlasconfig.AtlasConfig) HTTPClient {
+func getAtlasClient(atlasConfig atlasconfig.AtlasConfig, rateLimiter *rate.Limiter) HTTPClient {
+	digestTransport := &digest.Transport{
+		Username: atlasConfig.PublicKey,
+		Password: atlasConfig.PrivateKey,
+	}
 	return &http.Client{
-		Transport: &digest.Transport{
-			Username: atlasConfig.PublicKey,
-			Password: atlasConfig.PrivateKey,
-		},
+		Transport: httpclient.NewTransport(digestTransport, httpclient.Config{
+			HostLimiters: map[string]*rate.Limiter{
+				"cloud.mongodb.com": rateLimiter,
+			},
+		}),
 	}
 }
 
@@ -83,6 +93,9 @@ type AtlasCostSource struct {
 	orgID       string
 	rateLimiter *rate.Limiter
 	atlasClient HTTPClient
+	// costSource fetches the windows of each request with the cache, timeout
+	// and parallelism in the config
+	costSource *sdk.CostSource
 }
 
 type HTTPClient interface {
@@ -126,42 +139,23 @@ func (a *AtlasCostSource) GetCustomCosts(req *pb.CustomCostRequest) []*pb.Custom
 		return results
 	}
 
-	targets, err := opencost.GetWindows(req.Start.AsTime(), req.End.AsTime(), req.Resolution.AsDuration())
-	if err != nil {
-		log.Errorf("error getting windows: %v", err)
-		errResp := pb.CustomCostResponse{
-			Errors: []string{fmt.Sprintf("error getting windows: %v", err)},
-		}
-		results = append(results, &errResp)
-		return results
-	}
-
-	lineItems, err := GetPendingInvoices(a.orgID, a.atlasClient)
-
-	if err != nil {
-		log.Errorf("Error fetching invoices: %v", err)
-		errResp := pb.CustomCostResponse{
-			Errors: []string{fmt.Sprintf("error fetching invoices: %v", err)},
-		}
-		results = append(results, &errResp)
-		return results
-
-	}
-
-	for _, target := range targets {
-		if target.Start().After(time.Now().UTC()) {
-			log.Debugf("skipping future window %v", target)
-			continue
+	// the pending invoice covers the whole request, so it is fetched once by
+	// the first window that isn't cached, and every window is filtered from
+	// the same line items
+	var fetchInvoices sync.Once
+	var lineItems []atlasplugin.LineItem
+	var invoicesErr error
+	src := *a.costSource
+	src.Fetch = func(ctx context.Context, target opencost.Window) (*pb.CustomCostResponse, error) {
+		fetchInvoices.Do(func() {
+			lineItems, invoicesErr = GetPendingInvoices(ctx, a.orgID, a.atlasClient)
+		})
+		if invoicesErr != nil {
+			return nil, fmt.Errorf("error fetching invoices: %v", invoicesErr)
 		}
-
-		log.Debugf("fetching atlas costs for window %v", target)
-		result := a.getAtlasCostsForWindow(&target, lineItems)
-
-		results = append(results, result)
-
+		return a.getAtlasCostsForWindow(&target, lineItems), nil
 	}
-
-	return results
+	return src.GetCustomCosts(req)
 }
 
 func filterLineItemsByWindow(win *opencost.Window, lineItems []atlasplugin.LineItem) []*pb.CustomCost {
@@ -235,8 +229,8 @@ func (a *AtlasCostSource) getAtlasCostsForWindow(win *opencost.Window, lineItems
 	return &resp
 }
 
-func GetPendingInvoices(org string, client HTTPClient) ([]atlasplugin.LineItem, error) {
-	request, _ := http.NewRequest("GET", fmt.Sprintf(costExplorerPendingInvoicesURL, org), nil)
+func GetPendingInvoices(ctx context.Context, org string, client HTTPClient) ([]atlasplugin.LineItem, error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf(costExplorerPendingInvoicesURL, org), nil)
 
 	request.Header.Set("Accept", "application/vnd.atlas.2023-01-01+json")
 	request.Header.Set("Content-Type", "application/vnd.atlas.2023-01-01+json")
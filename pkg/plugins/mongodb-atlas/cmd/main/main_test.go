@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/icholy/digest"
+	"github.com/opencost/opencost-plugins/common/sdk"
 	atlasplugin "github.com/opencost/opencost-plugins/pkg/plugins/mongodb-atlas/plugin"
 	"github.com/opencost/opencost/core/pkg/model/pb"
 	"github.com/opencost/opencost/core/pkg/opencost"
@@ -57,6 +59,7 @@ func TestMain(t *testing.T) {
 	}
 
 	atlasCostSource := AtlasCostSource{
+		costSource:  &sdk.CostSource{Name: "mongodb-atlas"},
 		orgID:       "myOrg",
 		atlasClient: client,
 	}
@@ -136,7 +139,7 @@ func TestGetCostsPendingInvoices(t *testing.T) {
 			}, nil
 		},
 	}
-	lineItems, err := GetPendingInvoices("myOrg", mockClient)
+	lineItems, err := GetPendingInvoices(context.Background(), "myOrg", mockClient)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(lineItems))
 
@@ -157,7 +160,7 @@ func TestGetCostErrorFromServer(t *testing.T) {
 			return nil, fmt.Errorf("mock error: failed to execute request")
 		},
 	}
-	costs, err := GetPendingInvoices("myOrg", mockClient)
+	costs, err := GetPendingInvoices(context.Background(), "myOrg", mockClient)
 
 	assert.NotEmpty(t, err)
 	assert.Nil(t, costs)
@@ -177,7 +180,7 @@ func TestGetCostsBadMessage(t *testing.T) {
 		},
 	}
 
-	_, error := GetPendingInvoices("myOrd", mockClient)
+	_, error := GetPendingInvoices(context.Background(), "myOrd", mockClient)
 	assert.NotEmpty(t, error)
 
 }
@@ -185,7 +188,8 @@ func TestGetCostsBadMessage(t *testing.T) {
 func TestGetAtlasCostsForWindow(t *testing.T) {
 
 	atlasCostSource := AtlasCostSource{
-		orgID: "myOrg",
+		costSource: &sdk.CostSource{Name: "mongodb-atlas"},
+		orgID:      "myOrg",
 	}
 	// Define the start and end time for the window
 	day1 := time.Date(2024, time.October, 12, 0, 0, 0, 0, time.UTC) // Now
@@ -269,6 +273,7 @@ func TestGetCosts(t *testing.T) {
 		},
 	}
 	atlasCostSource := AtlasCostSource{
+		costSource:  &sdk.CostSource{Name: "mongodb-atlas"},
 		orgID:       "myOrg",
 		atlasClient: mockClient,
 	}
@@ -444,6 +449,7 @@ func TestBadWindow(t *testing.T) {
 		},
 	}
 	atlasCostSource := AtlasCostSource{
+		costSource:  &sdk.CostSource{Name: "mongodb-atlas"},
 		orgID:       "myOrg",
 		atlasClient: mockClient,
 	}
@@ -471,6 +477,7 @@ func TestGetCostsReturnsErrorForPendingInvoices(t *testing.T) {
 		},
 	}
 	atlasCostSource := AtlasCostSource{
+		costSource:  &sdk.CostSource{Name: "mongodb-atlas"},
 		orgID:       "myOrg",
 		atlasClient: mockClient,
 	}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/opencost/opencost-plugins/common/validation"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // the validator is designed to allow plugin implementors to validate their plugin information
@@ -36,7 +36,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	dailyCustomCostResponses, err := Unmarshal(data)
+	dailyCustomCostResponses, err := validation.Unmarshal(data)
 	if err != nil {
 		fmt.Printf("Error unmarshalling daily protobuf data: %v\n", err)
 		os.Exit(1)
@@ -54,7 +54,7 @@ func main() {
 	}
 
 	// read in the protobuf file
-	hourlyCustomCostResponses, err := Unmarshal(data)
+	hourlyCustomCostResponses, err := validation.Unmarshal(data)
 	if err != nil {
 		fmt.Printf("Error unmarshalling hourly protobuf data: %v\n", err)
 		os.Exit(1)
@@ -84,17 +84,9 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 
 	var multiErr error
 
-	// parse the response and look for errors
-	for _, resp := range respDaily {
-		if len(resp.Errors) > 0 {
-			multiErr = multierror.Append(multiErr, fmt.Errorf("errors occurred in daily response: %v", resp.Errors))
-		}
-	}
-
-	for _, resp := range respHourly {
-		if resp.Errors != nil {
-			multiErr = multierror.Append(multiErr, fmt.Errorf("errors occurred in hourly response: %v", resp.Errors))
-		}
+	// check the responses against the FOCUS rules shared by all plugins
+	if err := validation.ValidateResponses(respDaily, "mongodb-atlas", 24*time.Hour); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("invalid daily response: %v", err))
 	}
 
 	// check if any errors occurred
@@ -152,30 +144,5 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 		return false
 	}
 
-	// verify the domain matches the plugin name
-	for _, resp := range respDaily {
-		if resp.Domain != "mongodb-atlas" {
-			log.Errorf("daily domain returned by plugin mongodb-atlas does not match plugin name")
-			return false
-		}
-	}
-
 	return true
 }
-
-func Unmarshal(data []byte) ([]*pb.CustomCostResponse, error) {
-	var raw []json.RawMessage
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return nil, err
-	}
-	protoResps := make([]*pb.CustomCostResponse, len(raw))
-	for i, r := range raw {
-		p := &pb.CustomCostResponse{}
-		if err := protojson.Unmarshal(r, p); err != nil {
-			return nil, err
-		}
-		protoResps[i] = p
-	}
-
-	return protoResps, nil
-}
@@ -1,31 +1,26 @@
 package config
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
+
+	commonconfig "github.com/opencost/opencost-plugins/common/config"
+	"github.com/opencost/opencost-plugins/common/sdk"
 )
 
 type AtlasConfig struct {
-	PublicKey  string `json:"atlas_public_key"`
-	PrivateKey string `json:"atlas_private_key"`
-	OrgID      string `json:"atlas_org_id"`
-	LogLevel   string `json:"atlas_plugin_log_level"`
+	PublicKey  string `json:"atlas_public_key" required:"true"`
+	PrivateKey string `json:"atlas_private_key" required:"true"`
+	OrgID      string `json:"atlas_org_id" required:"true"`
+	LogLevel   string `json:"atlas_plugin_log_level" default:"info"`
+	// Config holds the caching, timeout, parallelism, metrics and tracing
+	// settings. Windows are only cached 48 hours after they end by default.
+	sdk.Config
 }
 
 func GetAtlasConfig(configFilePath string) (*AtlasConfig, error) {
 	var result AtlasConfig
-	bytes, err := os.ReadFile(configFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file for Atlas config @ %s: %v", configFilePath, err)
-	}
-	err = json.Unmarshal(bytes, &result)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling json into Atlas config %v", err)
-	}
-
-	if result.LogLevel == "" {
-		result.LogLevel = "info"
+	if err := commonconfig.Load(configFilePath, &result); err != nil {
+		return nil, fmt.Errorf("error loading Atlas config: %v", err)
 	}
 
 	return &result, nil
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +13,7 @@ func TestGetAtlasConfig(t *testing.T) {
 	t.Run("Valid configuration file", func(t *testing.T) {
 		configFilePath := "test_valid_config.json"
 		// Create a temporary valid JSON file
-		validConfig := `{"atlas_plugin_log_level": "debug"}`
+		validConfig := `{"atlas_public_key": "public", "atlas_private_key": "private", "atlas_org_id": "myOrg", "atlas_plugin_log_level": "debug"}`
 		err := os.WriteFile(configFilePath, []byte(validConfig), 0644)
 		if err != nil {
 			t.Fatalf("failed to create temporary config file: %v", err)
@@ -59,7 +60,7 @@ func TestGetAtlasConfig(t *testing.T) {
 	t.Run("Default log level when missing", func(t *testing.T) {
 		configFilePath := "test_missing_log_level.json"
 		// Create a temporary JSON file without log_level
-		missingLogLevelConfig := `{}`
+		missingLogLevelConfig := `{"atlas_public_key": "public", "atlas_private_key": "private", "atlas_org_id": "myOrg"}`
 		err := os.WriteFile(configFilePath, []byte(missingLogLevelConfig), 0644)
 		if err != nil {
 			t.Fatalf("failed to create temporary config file: %v", err)
@@ -74,4 +75,46 @@ func TestGetAtlasConfig(t *testing.T) {
 			t.Errorf("expected log level to be 'info', but got: %s", config.LogLevel)
 		}
 	})
+	// Test: Missing keys
+	t.Run("Missing required keys", func(t *testing.T) {
+		configFilePath := "test_missing_keys.json"
+		// Create a temporary JSON file without the org id
+		missingKeysConfig := `{"atlas_public_key": "public", "atlas_private_key": "private"}`
+		err := os.WriteFile(configFilePath, []byte(missingKeysConfig), 0644)
+		if err != nil {
+			t.Fatalf("failed to create temporary config file: %v", err)
+		}
+		defer os.Remove(configFilePath)
+
+		_, err = GetAtlasConfig(configFilePath)
+		if err == nil || !strings.Contains(err.Error(), "atlas_org_id") {
+			t.Errorf("expected an error naming atlas_org_id, but got: %v", err)
+		}
+	})
+
+	// Test: Private key from a mounted secret
+	t.Run("Private key from secret file", func(t *testing.T) {
+		configFilePath := "test_secret_file.json"
+		secretFilePath := "test_private_key"
+		err := os.WriteFile(secretFilePath, []byte("private\n"), 0600)
+		if err != nil {
+			t.Fatalf("failed to create temporary secret file: %v", err)
+		}
+		defer os.Remove(secretFilePath)
+		secretConfig := `{"atlas_public_key": "${TEST_ATLAS_PUBLIC_KEY}", "atlas_private_key": "file:test_private_key", "atlas_org_id": "myOrg"}`
+		err = os.WriteFile(configFilePath, []byte(secretConfig), 0644)
+		if err != nil {
+			t.Fatalf("failed to create temporary config file: %v", err)
+		}
+		defer os.Remove(configFilePath)
+		t.Setenv("TEST_ATLAS_PUBLIC_KEY", "public")
+
+		config, err := GetAtlasConfig(configFilePath)
+		if err != nil {
+			t.Fatalf("expected no error, but got: %v", err)
+		}
+		if config.PublicKey != "public" || config.PrivateKey != "private" {
+			t.Errorf("expected keys from environment and secret file, but got: %s, %s", config.PublicKey, config.PrivateKey)
+		}
+	})
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// dayCache holds the organization costs of each day for the windows of a
+// single request, so hourly windows in the same day share one set of calls,
+// and windows fetched at the same time wait for the same fetch. A nil
+// dayCache fetches every time.
+type dayCache struct {
+	mu      sync.Mutex
+	entries map[time.Time]*dayEntry
+}
+
+type dayEntry struct {
+	// ready is closed once day and err are set
+	ready chan struct{}
+	day   *organizationDay
+	err   error
+}
+
+func newDayCache() *dayCache {
+	return &dayCache{
+		entries: map[time.Time]*dayEntry{},
+	}
+}
+
+// get returns the costs of the day starting at dayStart, calling fetch if
+// they aren't cached. Errors aren't cached.
+func (c *dayCache) get(ctx context.Context, dayStart time.Time, fetch func() (*organizationDay, error)) (*organizationDay, error) {
+	if c == nil {
+		return fetch()
+	}
+
+	c.mu.Lock()
+	entry, found := c.entries[dayStart]
+	if !found {
+		entry = &dayEntry{ready: make(chan struct{})}
+		c.entries[dayStart] = entry
+		c.mu.Unlock()
+
+		entry.day, entry.err = fetch()
+		if entry.err != nil {
+			c.mu.Lock()
+			delete(c.entries, dayStart)
+			c.mu.Unlock()
+		}
+		close(entry.ready)
+		return entry.day, entry.err
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.day, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
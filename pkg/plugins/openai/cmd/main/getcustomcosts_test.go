@@ -1,10 +1,13 @@
 package main
 
 import (
+	"math"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/opencost/opencost-plugins/common/sdk"
+	"github.com/opencost/opencost-plugins/common/validation"
 	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
@@ -32,6 +35,7 @@ func TestGetCustomCosts(t *testing.T) {
 	oaiCostSrc := OpenAICostSource{
 		rateLimiter: rateLimiter,
 		config:      &config,
+		costSource:  &sdk.CostSource{Name: "openai"},
 	}
 
 	windowStart := time.Date(2024, 10, 9, 0, 0, 0, 0, time.UTC)
@@ -51,3 +55,98 @@ func TestGetCustomCosts(t *testing.T) {
 		t.Fatalf("empty response")
 	}
 }
+
+func TestGetCustomCostsFromUsageAndBilling(t *testing.T) {
+	web, search := "proj_web", "proj_search"
+	webName := "Web"
+	key1, key1Name := "key_1", "web backend"
+	key2, key2Name := "key_2", "web batch"
+	usage := &openaiplugin.OpenAIUsage{
+		Data: []openaiplugin.UsageData{
+			{SnapshotID: "gpt-4o-2024-08-06", NContextTokensTotal: 600000, NCachedContextTokensTotal: 200000, NGeneratedTokensTotal: 50000, ProjectID: &web, ProjectName: &webName, APIKeyID: &key1, APIKeyName: &key1Name},
+			{SnapshotID: "gpt-4o-2024-08-06", NContextTokensTotal: 400000, ProjectID: &web, ProjectName: &webName, APIKeyID: &key2, APIKeyName: &key2Name},
+			// another project's usage isn't counted in the web project's costs
+			{SnapshotID: "gpt-4o-2024-08-06", NContextTokensTotal: 9000000, ProjectID: &search},
+			{SnapshotID: "dall-e-3", ProjectID: &web},
+		},
+	}
+	billing := &openaiplugin.OpenAIBilling{
+		Data: []openaiplugin.BillingData{
+			{Name: "GPT-4o", CostInMajor: 3.5, OrganizationID: "org", ProjectID: web, ProjectName: webName},
+			{Name: "DALL-E 3", CostInMajor: 0.8, OrganizationID: "org", ProjectID: web, ProjectName: webName},
+		},
+	}
+	prices, err := openaiplugin.LoadModelPrices(openaiplugin.ModelPrices{})
+	if err != nil {
+		t.Fatalf("error loading model prices: %v", err)
+	}
+	projectLabels := map[string]map[string]string{"Web": {"namespace": "web"}}
+
+	customCosts, err := getCustomCostsFromUsageAndBilling(usage, billing, prices, projectLabels)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	costs := map[string]*pb.CustomCost{}
+	for _, cost := range customCosts {
+		costs[cost.ProviderId] = cost
+	}
+
+	// at list prices the project's tokens cost $1 input, $0.25 cached input
+	// and $0.50 output with the first key, and $1 input with the second, so
+	// the billed $3.50 is split in the same proportion. It's more than the
+	// model prices, so the list prices are raised to what was billed.
+	above := 3.5 / 2.75
+	expected := map[string]struct {
+		billed    float64
+		tokens    float32
+		unitPrice float64
+		apiKey    string
+	}{
+		"org/proj_web/key_1/GPT-4o/input":        {1 * above, 400000, 2.5e-6 * above, key1Name},
+		"org/proj_web/key_1/GPT-4o/cached input": {0.25 * above, 200000, 1.25e-6 * above, key1Name},
+		"org/proj_web/key_1/GPT-4o/output":       {0.5 * above, 50000, 10e-6 * above, key1Name},
+		"org/proj_web/key_2/GPT-4o/input":        {1 * above, 400000, 2.5e-6 * above, key2Name},
+		// images have no token price, so they're reported as a whole
+		"org/proj_web/DALL-E 3": {0.8, 0, 0, ""},
+	}
+	if len(costs) != len(expected) {
+		t.Fatalf("expected %d costs, got %v", len(expected), customCosts)
+	}
+	for id, want := range expected {
+		cost := costs[id]
+		if cost == nil {
+			t.Errorf("no cost with provider id %s in %v", id, customCosts)
+			continue
+		}
+		if math.Abs(float64(cost.BilledCost)-want.billed) > 1e-6 || cost.UsageQuantity != want.tokens || math.Abs(float64(cost.ListUnitPrice)-want.unitPrice) > 1e-12 {
+			t.Errorf("expected cost %s to be billed %f for %f tokens at %g, got %v", id, want.billed, want.tokens, want.unitPrice, cost)
+		}
+		if err := validation.ValidateCost(cost); err != nil {
+			t.Errorf("invalid cost %s: %v", id, err)
+		}
+		if cost.Labels["project"] != webName || cost.Labels["api_key"] != want.apiKey || cost.Labels["namespace"] != "web" {
+			t.Errorf("expected cost %s to be labelled with its project, API key and namespace, got %v", id, cost.Labels)
+		}
+	}
+}
+
+func TestListPricing(t *testing.T) {
+	tests := []struct {
+		name                       string
+		quantity, billedCost       float64
+		expectedUnit, expectedList float64
+	}{
+		{name: "billed at list", quantity: 1000000, billedCost: 2.5, expectedUnit: 2.5e-6, expectedList: 2.5},
+		{name: "billed below list", quantity: 1000000, billedCost: 1.25, expectedUnit: 2.5e-6, expectedList: 2.5},
+		{name: "billed above list", quantity: 1000000, billedCost: 5, expectedUnit: 5e-6, expectedList: 5},
+		{name: "no tokens", quantity: 0, billedCost: 1, expectedUnit: 2.5e-6, expectedList: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unitPrice, listCost := listPricing(tt.quantity, 2.5e-6, tt.billedCost)
+			if math.Abs(unitPrice-tt.expectedUnit) > 1e-12 || math.Abs(listCost-tt.expectedList) > 1e-9 {
+				t.Errorf("expected %g per token and %f list cost, got %g and %f", tt.expectedUnit, tt.expectedList, unitPrice, listCost)
+			}
+		})
+	}
+}
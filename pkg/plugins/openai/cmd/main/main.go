@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,26 +15,16 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/google/uuid"
-	"github.com/hashicorp/go-plugin"
-	commonconfig "github.com/opencost/opencost-plugins/pkg/common/config"
+	commonconfig "github.com/opencost/opencost-plugins/common/config"
+	"github.com/opencost/opencost-plugins/common/httpclient"
+	"github.com/opencost/opencost-plugins/common/sdk"
 	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
 	"github.com/opencost/opencost/core/pkg/opencost"
-	ocplugin "github.com/opencost/opencost/core/pkg/plugin"
 	"github.com/opencost/opencost/core/pkg/util/timeutil"
 )
 
-// handshakeConfigs are used to just do a basic handshake between
-// a plugin and host. If the handshake fails, a user friendly error is shown.
-// This prevents users from executing bad plugins or executing a plugin
-// directory. It is a UX feature, not a security feature.
-var handshakeConfig = plugin.HandshakeConfig{
-	ProtocolVersion:  1,
-	MagicCookieKey:   "PLUGIN_NAME",
-	MagicCookieValue: "openai",
-}
-
 const openAIUsageURLFmt = "https://api.openai.com/v1/usage?date=%s"
 const openAIBillingURLFmt = "https://api.openai.com/v1/dashboard/billing/usage/export?exclude_project_costs=false&file_format=json&new_endpoint=true&project_id&start_date=%s&end_date=%s"
 const openAIAPIDateFormat = "2006-01-02"
@@ -44,39 +33,31 @@ const openAIAPIDateFormat = "2006-01-02"
 type OpenAICostSource struct {
 	rateLimiter *rate.Limiter
 	config      *openaiplugin.OpenAIConfig
+	// costSource fetches the windows of each request with the cache, timeout
+	// and parallelism in the config
+	costSource *sdk.CostSource
+	// organizationURL is the base URL of the organization usage and costs APIs
+	organizationURL string
+	modelPrices     *openaiplugin.ModelPrices
+	// names are the names of the organization's projects and API keys
+	names organizationNames
 }
 
 func (d *OpenAICostSource) GetCustomCosts(req *pb.CustomCostRequest) []*pb.CustomCostResponse {
-	results := []*pb.CustomCostResponse{}
-
-	targets, err := opencost.GetWindows(req.Start.AsTime(), req.End.AsTime(), req.Resolution.AsDuration())
-	if err != nil {
-		log.Errorf("error getting windows: %v", err)
-		errResp := pb.CustomCostResponse{
-			Errors: []string{fmt.Sprintf("error getting windows: %v", err)},
-		}
-		results = append(results, &errResp)
-		return results
-	}
-
-	if req.Resolution.AsDuration() != timeutil.Day {
-		log.Infof("openai plugin only supports daily resolution")
-		return results
+	resolution := req.Resolution.AsDuration()
+	hourly := resolution == time.Hour && d.config.AdminKey != ""
+	if resolution != timeutil.Day && !hourly {
+		log.Infof("openai plugin only supports daily resolution, or hourly resolution with an admin key")
+		return []*pb.CustomCostResponse{}
 	}
 
-	for _, target := range targets {
-		// don't allow future request
-		if target.Start().After(time.Now().UTC()) {
-			log.Debugf("skipping future window %v", target)
-			continue
-		}
-
-		log.Debugf("fetching Open AI costs for window %v", target)
-		result := d.getOpenAICostsForWindow(target)
-		results = append(results, result)
+	// hourly windows share the costs of their day
+	days := newDayCache()
+	src := *d.costSource
+	src.Fetch = func(ctx context.Context, target opencost.Window) (*pb.CustomCostResponse, error) {
+		return d.getOpenAICostsForWindow(ctx, target, days), nil
 	}
-
-	return results
+	return src.GetCustomCosts(req)
 }
 
 func main() {
@@ -86,28 +67,52 @@ func main() {
 		log.Fatalf("error opening config file: %v", err)
 	}
 
-	oaiConfig, err := getOpenAIConfig(configFile)
+	// rate limit to 1 request per second. The limiter outlives config
+	// reloads, so rotating keys doesn't reset it.
+	rateLimiter := rate.NewLimiter(0.5, 1)
+	var oaiCostSrc sdk.SwappableSource
+	_, err = commonconfig.Watch(configFile, commonconfig.DefaultWatchInterval, func(oaiConfig *openaiplugin.OpenAIConfig) error {
+		src, err := newOpenAICostSource(oaiConfig, rateLimiter)
+		if err != nil {
+			return err
+		}
+		if err := sdk.StartTelemetry("openai", oaiConfig.Config); err != nil {
+			return err
+		}
+		log.SetLogLevel(oaiConfig.LogLevel)
+		oaiCostSrc.Store(src)
+		return nil
+	})
 	if err != nil {
 		log.Fatalf("error building OpenAI config: %v", err)
 	}
-	log.SetLogLevel(oaiConfig.LogLevel)
-	// rate limit to 1 request per second
-	rateLimiter := rate.NewLimiter(0.5, 1)
-	oaiCostSrc := OpenAICostSource{
-		rateLimiter: rateLimiter,
-		config:      oaiConfig,
-	}
 
-	// pluginMap is the map of plugins we can dispense.
-	var pluginMap = map[string]plugin.Plugin{
-		"CustomCostSource": &ocplugin.CustomCostPlugin{Impl: &oaiCostSrc},
+	sdk.Serve("openai", &oaiCostSrc)
+}
+
+// newOpenAICostSource builds a cost source with the credentials and settings
+// in oaiConfig. A new one is built every time the config is reloaded.
+func newOpenAICostSource(oaiConfig *openaiplugin.OpenAIConfig, rateLimiter *rate.Limiter) (*OpenAICostSource, error) {
+	// OpenAI's daily usage and billing settle within a day
+	costSource, err := sdk.NewCostSource("openai", oaiConfig.Config, 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if oaiConfig.AdminKey == "" && oaiConfig.APIKey == "" {
+		return nil, fmt.Errorf("either an admin key or an API key is required")
+	}
+	modelPrices, err := openaiplugin.LoadModelPrices(oaiConfig.ModelPrices)
+	if err != nil {
+		return nil, err
 	}
 
-	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: handshakeConfig,
-		Plugins:         pluginMap,
-		GRPCServer:      plugin.DefaultGRPCServer,
-	})
+	return &OpenAICostSource{
+		rateLimiter:     rateLimiter,
+		config:          oaiConfig,
+		costSource:      costSource,
+		organizationURL: openAIOrganizationURL,
+		modelPrices:     modelPrices,
+	}, nil
 }
 
 func boilerplateOpenAICustomCost(win opencost.Window) pb.CustomCostResponse {
@@ -123,29 +128,63 @@ func boilerplateOpenAICustomCost(win opencost.Window) pb.CustomCostResponse {
 		Costs:      []*pb.CustomCost{},
 	}
 }
-func (d *OpenAICostSource) getOpenAICostsForWindow(window opencost.Window) *pb.CustomCostResponse {
+func (d *OpenAICostSource) getOpenAICostsForWindow(ctx context.Context, window opencost.Window, days *dayCache) *pb.CustomCostResponse {
 	ccResp := boilerplateOpenAICustomCost(window)
+	ccResp.Metadata["model_prices_version"] = d.modelPrices.Version
+	if d.config.AdminKey == "" {
+		ccResp.Metadata["api"] = "legacy"
+		d.getLegacyCostsForWindow(ctx, window, &ccResp)
+		return &ccResp
+	}
 
-	oaiTokenUsages, err := d.getOpenAITokenUsages(*window.Start())
+	ccResp.Metadata["api"] = "organization"
+	if window.Duration() != timeutil.Day {
+		ccResp.Metadata["apportioned"] = "true"
+	}
+	customCosts, err := d.getOrganizationCostsForWindow(ctx, window, days)
+	if err == nil {
+		ccResp.Costs = customCosts
+		return &ccResp
+	}
+	// the legacy APIs only have daily costs
+	if d.config.APIKey == "" || window.Duration() != timeutil.Day {
+		ccResp.Errors = append(ccResp.Errors, fmt.Sprintf("error getting OpenAI organization costs: %v", err))
+		return &ccResp
+	}
+
+	log.Warnf("error getting OpenAI organization costs, falling back to the legacy APIs: %v", err)
+	ccResp.Metadata["api"] = "legacy"
+	ccResp.Metadata["organization_api_error"] = err.Error()
+	d.getLegacyCostsForWindow(ctx, window, &ccResp)
+	return &ccResp
+}
+
+// getLegacyCostsForWindow adds the costs in window from the legacy usage and
+// billing export APIs to ccResp.
+func (d *OpenAICostSource) getLegacyCostsForWindow(ctx context.Context, window opencost.Window, ccResp *pb.CustomCostResponse) {
+	oaiTokenUsages, err := d.getOpenAITokenUsages(ctx, *window.Start())
 	if err != nil {
 		ccResp.Errors = append(ccResp.Errors, fmt.Sprintf("error getting OpenAI token usages: %v", err))
 	}
 
-	oaiBilling, err := d.getOpenAIBilling(*window.Start(), *window.End())
+	oaiBilling, err := d.getOpenAIBilling(ctx, *window.Start(), *window.End())
 	if err != nil {
 		ccResp.Errors = append(ccResp.Errors, fmt.Sprintf("error getting OpenAI billing data: %v", err))
 	}
 
-	customCosts, err := getCustomCostsFromUsageAndBilling(oaiTokenUsages, oaiBilling)
+	customCosts, err := getCustomCostsFromUsageAndBilling(oaiTokenUsages, oaiBilling, d.modelPrices, d.config.ProjectLabels)
 	if err != nil {
 		ccResp.Errors = append(ccResp.Errors, fmt.Sprintf("error converting API responses into custom costs: %v", err))
 	}
 	ccResp.Costs = customCosts
-
-	return &ccResp
 }
 
-func getCustomCostsFromUsageAndBilling(usage *openaiplugin.OpenAIUsage, billing *openaiplugin.OpenAIBilling) ([]*pb.CustomCost, error) {
+// getCustomCostsFromUsageAndBilling converts each billing entry to a custom
+// cost per API key and kind of token of its project's usage of its model. The
+// billing export only has the total cost of a model in a project, so it's
+// split between the API keys and kinds of tokens in proportion to their list
+// cost. Models without token usage or a price are reported as a whole.
+func getCustomCostsFromUsageAndBilling(usage *openaiplugin.OpenAIUsage, billing *openaiplugin.OpenAIBilling, prices *openaiplugin.ModelPrices, projectLabels map[string]map[string]string) ([]*pb.CustomCost, error) {
 	customCosts := []*pb.CustomCost{}
 
 	tokenMap := buildTokenMap(usage)
@@ -154,116 +193,203 @@ func getCustomCostsFromUsageAndBilling(usage *openaiplugin.OpenAIUsage, billing
 		tokenMapKey = strings.ReplaceAll(tokenMapKey, " ", "")
 		tokenMapKey = strings.ReplaceAll(tokenMapKey, "_", "")
 
-		tokenCount, ok := tokenMap[tokenMapKey]
+		keyTokens, ok := tokenMap[billingEntry.ProjectID+"/"+tokenMapKey]
 		if !ok {
-			log.Debugf("no token usage found for %s", billingEntry.Name)
-			tokenCount = -1
+			// FOCUS doesn't allow negative quantities, so an unknown token count is reported as 0
+			log.Debugf("no token usage found for %s in project %s", billingEntry.Name, billingEntry.ProjectID)
+		}
+		price, hasPrice := prices.Lookup(billingEntry.Name)
+		if !hasPrice && len(keyTokens) > 0 {
+			price, hasPrice = prices.Lookup(keyTokens[0].model)
 		}
 
-		extendedAttrs := pb.CustomCostExtendedAttributes{
-			AccountId:    &billingEntry.OrganizationID,
-			SubAccountId: &billingEntry.ProjectID,
+		var listCostTotal float64
+		if hasPrice {
+			for _, tokens := range keyTokens {
+				for _, kind := range openaiplugin.TokenKinds {
+					listCostTotal += float64(tokens.byKind[kind]) * price.UnitPrice(kind)
+				}
+			}
 		}
-		customCost := pb.CustomCost{
-			BilledCost:         float32(billingEntry.CostInMajor),
-			AccountName:        billingEntry.OrganizationName,
-			ChargeCategory:     "Usage",
-			Description:        fmt.Sprintf("OpenAI usage for model %s", billingEntry.Name),
-			ResourceName:       billingEntry.Name,
-			ResourceType:       "AI Model",
-			Id:                 uuid.New().String(),
-			ProviderId:         fmt.Sprintf("%s/%s/%s", billingEntry.OrganizationID, billingEntry.ProjectID, billingEntry.Name),
-			UsageQuantity:      float32(tokenCount),
-			UsageUnit:          "tokens - All snapshots, all projects",
-			ExtendedAttributes: &extendedAttrs,
+		if listCostTotal == 0 {
+			var totalTokens int
+			for _, tokens := range keyTokens {
+				totalTokens += tokens.total()
+			}
+			customCost := newLegacyCustomCost(billingEntry, billingEntry.CostInMajor)
+			customCost.Description = fmt.Sprintf("OpenAI usage for model %s", billingEntry.Name)
+			customCost.ProviderId = fmt.Sprintf("%s/%s/%s", billingEntry.OrganizationID, billingEntry.ProjectID, billingEntry.Name)
+			customCost.UsageQuantity = float32(totalTokens)
+			customCost.Labels = costLabels(projectLabels, billingEntry.ProjectID, billingEntry.ProjectName, "", "")
+			customCosts = append(customCosts, customCost)
+			continue
 		}
 
-		customCosts = append(customCosts, &customCost)
+		for _, tokens := range keyTokens {
+			for _, kind := range openaiplugin.TokenKinds {
+				if tokens.byKind[kind] == 0 {
+					continue
+				}
+				quantity := float64(tokens.byKind[kind])
+				billedCost := billingEntry.CostInMajor * quantity * price.UnitPrice(kind) / listCostTotal
+				listUnitPrice, listCost := listPricing(quantity, price.UnitPrice(kind), billedCost)
+				customCost := newLegacyCustomCost(billingEntry, billedCost)
+				customCost.Description = fmt.Sprintf("OpenAI %s tokens for model %s", kind, billingEntry.Name)
+				customCost.ProviderId = fmt.Sprintf("%s/%s/%s/%s/%s", billingEntry.OrganizationID, billingEntry.ProjectID, tokens.apiKeyID, billingEntry.Name, kind)
+				customCost.UsageQuantity = float32(quantity)
+				customCost.ListUnitPrice = float32(listUnitPrice)
+				customCost.ListCost = float32(listCost)
+				customCost.Labels = costLabels(projectLabels, billingEntry.ProjectID, billingEntry.ProjectName, tokens.apiKeyID, tokens.apiKeyName)
+				customCosts = append(customCosts, customCost)
+			}
+		}
 	}
 
 	return customCosts, nil
 }
 
+// listPricing returns the list unit price and list cost of quantity tokens
+// billed billedCost, at unitPrice from the model prices. OpenAI bills at list
+// price, so when the model prices come to less than was billed, e.g. because
+// they're out of date, the billed cost is taken as the list cost.
+func listPricing(quantity, unitPrice, billedCost float64) (float64, float64) {
+	listCost := quantity * unitPrice
+	if listCost >= billedCost {
+		return unitPrice, listCost
+	}
+	if quantity == 0 {
+		return unitPrice, billedCost
+	}
+	return billedCost / quantity, billedCost
+}
+
+// newLegacyCustomCost returns a custom cost of billedCost for billingEntry.
+func newLegacyCustomCost(billingEntry openaiplugin.BillingData, billedCost float64) *pb.CustomCost {
+	extendedAttrs := pb.CustomCostExtendedAttributes{
+		AccountId:      &billingEntry.OrganizationID,
+		SubAccountId:   &billingEntry.ProjectID,
+		SubAccountName: &billingEntry.ProjectName,
+	}
+	return &pb.CustomCost{
+		BilledCost:         float32(billedCost),
+		ListCost:           float32(billedCost),
+		AccountName:        billingEntry.OrganizationName,
+		ChargeCategory:     "Usage",
+		ResourceName:       billingEntry.Name,
+		ResourceType:       "AI Model",
+		Id:                 uuid.New().String(),
+		UsageUnit:          "tokens - All snapshots",
+		ExtendedAttributes: &extendedAttrs,
+	}
+}
+
+// costLabels returns the labels of costs of a project and API key: their
+// names and IDs, and the labels the config maps the project to by ID or name.
+// Empty values are left out.
+func costLabels(projectLabels map[string]map[string]string, projectID, projectName, apiKeyID, apiKeyName string) map[string]string {
+	labels := map[string]string{}
+	mapped, ok := projectLabels[projectID]
+	if !ok && projectName != "" {
+		mapped = projectLabels[projectName]
+	}
+	for key, value := range mapped {
+		labels[key] = value
+	}
+	for key, value := range map[string]string{
+		"project_id": projectID,
+		"project":    projectName,
+		"api_key_id": apiKeyID,
+		"api_key":    apiKeyName,
+	} {
+		if value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
 var snapshotRe = regexp.MustCompile(`-\d{4}-\d{2}-\d{2}|-`)
 
-func buildTokenMap(usage *openaiplugin.OpenAIUsage) map[string]int {
-	tokenMap := make(map[string]int)
+// modelTokens are the tokens of a model used with an API key on a day, by
+// kind of token.
+type modelTokens struct {
+	// model is a snapshot of the model, e.g. "gpt-4o-2024-08-06"
+	model      string
+	apiKeyID   string
+	apiKeyName string
+	byKind     map[string]int
+}
+
+func (t *modelTokens) total() int {
+	var total int
+	for _, tokens := range t.byKind {
+		total += tokens
+	}
+	return total
+}
+
+// buildTokenMap returns the tokens of each API key used with a model in a
+// project, keyed by the project and model without its snapshot.
+func buildTokenMap(usage *openaiplugin.OpenAIUsage) map[string][]*modelTokens {
+	tokenMap := make(map[string][]*modelTokens)
 	if usage == nil {
 		return tokenMap
 	}
 	for _, usageData := range usage.Data {
 		key := snapshotRe.ReplaceAllString(usageData.SnapshotID, "")
-		key = strings.ToLower(key)
-		if _, ok := tokenMap[key]; !ok {
-			tokenMap[key] = 0
+		key = stringValue(usageData.ProjectID) + "/" + strings.ToLower(key)
+		apiKeyID := stringValue(usageData.APIKeyID)
+
+		var tokens *modelTokens
+		for _, keyTokens := range tokenMap[key] {
+			if keyTokens.apiKeyID == apiKeyID {
+				tokens = keyTokens
+			}
+		}
+		if tokens == nil {
+			tokens = &modelTokens{
+				model:      usageData.SnapshotID,
+				apiKeyID:   apiKeyID,
+				apiKeyName: stringValue(usageData.APIKeyName),
+				byKind:     map[string]int{},
+			}
+			tokenMap[key] = append(tokenMap[key], tokens)
 		}
 
-		tokenMap[key] += (usageData.NGeneratedTokensTotal + usageData.NContextTokensTotal)
+		// cached tokens are counted in the context tokens too
+		tokens.byKind[openaiplugin.TokenKindInput] += usageData.NContextTokensTotal - usageData.NCachedContextTokensTotal
+		tokens.byKind[openaiplugin.TokenKindCachedInput] += usageData.NCachedContextTokensTotal
+		tokens.byKind[openaiplugin.TokenKindOutput] += usageData.NGeneratedTokensTotal
 	}
 	return tokenMap
 }
 
-func (d *OpenAICostSource) getOpenAIBilling(start time.Time, end time.Time) (*openaiplugin.OpenAIBilling, error) {
-	client := &http.Client{}
+// httpClient returns a client that holds requests to the OpenAI API to the
+// plugin's rate limit and retries them when OpenAI asks us to back off.
+func (d *OpenAICostSource) httpClient() *http.Client {
+	return httpclient.NewClient(httpclient.Config{
+		HostLimiters: map[string]*rate.Limiter{
+			"api.openai.com": d.rateLimiter,
+		},
+		// project IDs look like words, so they aren't recognized as IDs
+		Routes: []string{"/v1/organization/projects/{project_id}/api_keys"},
+	})
+}
+
+func (d *OpenAICostSource) getOpenAIBilling(ctx context.Context, start time.Time, end time.Time) (*openaiplugin.OpenAIBilling, error) {
 	openAIBillingURL := fmt.Sprintf(openAIBillingURLFmt, start.Format(openAIAPIDateFormat), end.Format(openAIAPIDateFormat))
 	log.Debugf("fetching OpenAI billing data from %s", openAIBillingURL)
-	var errReq error
-	var resp *http.Response
-	for i := 0; i < 3; i++ {
-		err := d.rateLimiter.Wait(context.Background())
-		if err != nil {
-			log.Warnf("error waiting for rate limiter: %v", err)
-			return nil, fmt.Errorf("error waiting for rate limiter: %v", err)
-		}
-		var req *http.Request
-		req, errReq = http.NewRequest("GET", openAIBillingURL, nil)
-		if errReq != nil {
-			log.Warnf("error creating billing export request: %v", errReq)
-			log.Infof("retrying request after 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", d.config.APIKey))
 
-		resp, errReq = client.Do(req)
-		if errReq != nil {
-			log.Warnf("error doing billing export request: %v", errReq)
-			log.Warnf("retrying requestafter 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		}
-
-		if resp.StatusCode != http.StatusOK {
-			bodyBytes, err := io.ReadAll(resp.Body)
-			bodyString := "<empty>"
-			if err != nil {
-				log.Warnf("error reading body of non-200 response: %v", err)
-			} else {
-				bodyString = string(bodyBytes)
-			}
-
-			errReq = fmt.Errorf("received non-200 response for billing export request: %d", resp.StatusCode)
-			log.Warnf("got non-200 response for billing export request: %d, body is: %s", resp.StatusCode, bodyString)
-			log.Infof("retrying request after 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		} else {
-			errReq = nil
-		}
-		// request was successful, break out of loop
-		break
+	resp, err := d.doOpenAIRequest(ctx, openAIBillingURL, d.config.APIKey)
+	if err != nil {
+		return nil, fmt.Errorf("error making billing export request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	if errReq != nil {
-		return nil, fmt.Errorf("error making request after retries: %v", errReq)
-	}
 	var billingData openaiplugin.OpenAIBilling
 	if err := json.NewDecoder(resp.Body).Decode(&billingData); err != nil {
 		return nil, fmt.Errorf("error decoding billing export response: %v", err)
 	}
-	resp.Body.Close()
 	for i := range billingData.Data {
 		asFloat, err := strconv.ParseFloat(billingData.Data[i].CostInMajorStr, 64)
 		if err != nil {
@@ -275,64 +401,15 @@ func (d *OpenAICostSource) getOpenAIBilling(start time.Time, end time.Time) (*op
 	return &billingData, nil
 }
 
-func (d *OpenAICostSource) getOpenAITokenUsages(targetTime time.Time) (*openaiplugin.OpenAIUsage, error) {
-	client := &http.Client{}
-
+func (d *OpenAICostSource) getOpenAITokenUsages(ctx context.Context, targetTime time.Time) (*openaiplugin.OpenAIUsage, error) {
 	openAIUsageURL := fmt.Sprintf(openAIUsageURLFmt, targetTime.Format(openAIAPIDateFormat))
 	log.Debugf("fetching OpenAI usage data from %s", openAIUsageURL)
-	var errReq error
-	var resp *http.Response
-	for i := 0; i < 3; i++ {
-		errReq = nil
-		err := d.rateLimiter.Wait(context.Background())
-		if err != nil {
-			log.Warnf("error waiting for rate limiter: %v", err)
-			return nil, fmt.Errorf("error waiting for rate limiter: %v", err)
-		}
-		var req *http.Request
-		req, errReq = http.NewRequest("GET", openAIUsageURL, nil)
-		if errReq != nil {
-			log.Warnf("error creating usage request: %v", errReq)
-			log.Warnf("retrying request after 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", d.config.APIKey))
-
-		resp, errReq = client.Do(req)
-		if errReq != nil {
-			log.Warnf("error doing token request: %v", errReq)
-			log.Infof("retrying request after 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			errReq = fmt.Errorf("received non-200 response for token usage request: %d", resp.StatusCode)
-			bodyBytes, err := io.ReadAll(resp.Body)
-			bodyString := "<empty>"
-			if err != nil {
-				log.Warnf("error reading body of non-200 response: %v", err)
-			} else {
-				bodyString = string(bodyBytes)
-			}
-			log.Warnf("got non-200 response for token usage request: %d, body is: %s", resp.StatusCode, bodyString)
-			log.Infof("retrying request after 30s")
-			time.Sleep(30 * time.Second)
-			continue
-		} else {
-			errReq = nil
-		}
-		// request was successful, break out of loop
-		break
-	}
-
-	if errReq != nil {
-		return nil, fmt.Errorf("error making request after retries: %v", errReq)
+	resp, err := d.doOpenAIRequest(ctx, openAIUsageURL, d.config.APIKey)
+	if err != nil {
+		return nil, fmt.Errorf("error making token usage request: %v", err)
 	}
+	defer resp.Body.Close()
 
 	var usageData openaiplugin.OpenAIUsage
 	if err := json.NewDecoder(resp.Body).Decode(&usageData); err != nil {
@@ -342,20 +419,34 @@ func (d *OpenAICostSource) getOpenAITokenUsages(targetTime time.Time) (*openaipl
 	return &usageData, nil
 }
 
-func getOpenAIConfig(configFilePath string) (*openaiplugin.OpenAIConfig, error) {
-	var result openaiplugin.OpenAIConfig
-	bytes, err := os.ReadFile(configFilePath)
+// doOpenAIRequest makes a GET request to the OpenAI API authenticated with
+// key. Any response other than a 200 is returned as an error.
+func (d *OpenAICostSource) doOpenAIRequest(ctx context.Context, url string, key string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error reading config file for openai config @ %s: %v", configFilePath, err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
-	err = json.Unmarshal(bytes, &result)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
+
+	resp, err := d.httpClient().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error marshaling json into openai config %v", err)
+		return nil, err
 	}
 
-	if result.LogLevel == "" {
-		result.LogLevel = "info"
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, err := io.ReadAll(resp.Body)
+		bodyString := "<empty>"
+		if err != nil {
+			log.Warnf("error reading body of non-200 response: %v", err)
+		} else {
+			bodyString = string(bodyBytes)
+		}
+		log.Warnf("got non-200 response for %s: %d, body is: %s", url, resp.StatusCode, bodyString)
+		return nil, fmt.Errorf("received non-200 response: %d", resp.StatusCode)
 	}
 
-	return &result, nil
+	return resp, nil
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+
+	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
+	"github.com/opencost/opencost/core/pkg/log"
+)
+
+// organizationNames holds the names of the organization's projects and API
+// keys, which the usage and costs APIs only report the IDs of. Names are
+// fetched the first time an unknown ID is seen, and kept until the config is
+// reloaded.
+type organizationNames struct {
+	mu sync.Mutex
+	// names are keyed by the kind of object and its ID, e.g. "project:proj_abc"
+	names map[string]string
+	// fetched records the IDs names were successfully fetched for, so names
+	// missing from the APIs, e.g. of deleted keys, aren't fetched for every
+	// window
+	fetched map[string]bool
+	// inflight are the fetches in progress, which are closed once done, so
+	// windows fetched at the same time wait for the same fetch
+	inflight map[string]chan struct{}
+}
+
+// projectName returns the name of the project, or "" if it's unknown.
+func (d *OpenAICostSource) projectName(ctx context.Context, projectID string) string {
+	if projectID == "" {
+		return ""
+	}
+	return d.names.lookup(ctx, "projects", "project:"+projectID, func() (map[string]string, error) {
+		projects, err := getOrganizationList[openaiplugin.Project](ctx, d, "projects", url.Values{"include_archived": {"true"}})
+		if err != nil {
+			return nil, fmt.Errorf("error getting OpenAI project names: %v", err)
+		}
+		names := map[string]string{}
+		for _, project := range projects {
+			names["project:"+project.ID] = project.Name
+		}
+		return names, nil
+	})
+}
+
+// apiKeyName returns the name of the project's API key, or "" if it's unknown.
+func (d *OpenAICostSource) apiKeyName(ctx context.Context, projectID, apiKeyID string) string {
+	if projectID == "" || apiKeyID == "" {
+		return ""
+	}
+	return d.names.lookup(ctx, "api_keys:"+projectID, "api_key:"+apiKeyID, func() (map[string]string, error) {
+		apiKeys, err := getOrganizationList[openaiplugin.ProjectAPIKey](ctx, d, "projects/"+projectID+"/api_keys", url.Values{})
+		if err != nil {
+			return nil, fmt.Errorf("error getting OpenAI API key names of project %s: %v", projectID, err)
+		}
+		names := map[string]string{}
+		for _, apiKey := range apiKeys {
+			names["api_key:"+apiKey.ID] = apiKey.Name
+		}
+		return names, nil
+	})
+}
+
+// lookup returns the name with key, calling fetch for names if it's unknown
+// and they haven't been fetched for it yet. Lookups with the same fetchKey
+// share a fetch. The lock isn't held while fetching, and failed fetches are
+// retried by the next lookup.
+func (n *organizationNames) lookup(ctx context.Context, fetchKey, key string, fetch func() (map[string]string, error)) string {
+	n.mu.Lock()
+	if name, ok := n.names[key]; ok || n.fetched[key] {
+		n.mu.Unlock()
+		return name
+	}
+	if done, found := n.inflight[fetchKey]; found {
+		n.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ""
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.names[key]
+	}
+	if n.inflight == nil {
+		n.inflight = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	n.inflight[fetchKey] = done
+	n.mu.Unlock()
+
+	fetched, err := fetch()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.inflight, fetchKey)
+	close(done)
+	if err != nil {
+		log.Warnf("%v", err)
+		return ""
+	}
+	if n.names == nil {
+		n.names = map[string]string{}
+		n.fetched = map[string]bool{}
+	}
+	for fetchedKey, name := range fetched {
+		n.names[fetchedKey] = name
+	}
+	n.fetched[key] = true
+	return n.names[key]
+}
+
+// getOrganizationList returns every object listed by the organization
+// administration API at path, following the cursor through every page.
+func getOrganizationList[T any](ctx context.Context, d *OpenAICostSource, path string, params url.Values) ([]T, error) {
+	var objects []T
+	params.Set("limit", "100")
+	for {
+		resp, err := d.doOpenAIRequest(ctx, d.organizationURL+"/"+path+"?"+params.Encode(), d.config.AdminKey)
+		if err != nil {
+			return nil, fmt.Errorf("error making %s request: %v", path, err)
+		}
+		var result openaiplugin.OrganizationList[T]
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s response: %v", path, err)
+		}
+
+		objects = append(objects, result.Data...)
+		if !result.HasMore || result.LastID == nil {
+			return objects, nil
+		}
+		params.Set("after", *result.LastID)
+	}
+}
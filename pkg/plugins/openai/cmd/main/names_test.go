@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrganizationNamesLookup(t *testing.T) {
+	t.Run("failed fetches are retried", func(t *testing.T) {
+		var names organizationNames
+		failing := func() (map[string]string, error) {
+			return nil, fmt.Errorf("boom")
+		}
+		if name := names.lookup(context.Background(), "projects", "project:proj_web", failing); name != "" {
+			t.Errorf("expected no name after a failed fetch, got %q", name)
+		}
+		name := names.lookup(context.Background(), "projects", "project:proj_web", func() (map[string]string, error) {
+			return map[string]string{"project:proj_web": "Web"}, nil
+		})
+		if name != "Web" {
+			t.Errorf("expected the name to be fetched again, got %q", name)
+		}
+	})
+
+	t.Run("concurrent lookups share a fetch", func(t *testing.T) {
+		var names organizationNames
+		var fetches atomic.Int32
+		release := make(chan struct{})
+		fetch := func() (map[string]string, error) {
+			fetches.Add(1)
+			<-release
+			return map[string]string{"api_key:key_1": "web backend"}, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if name := names.lookup(context.Background(), "api_keys:proj_web", "api_key:key_1", fetch); name != "web backend" {
+					t.Errorf("unexpected name %q", name)
+				}
+			}()
+		}
+
+		// other lookups aren't held up by the fetch
+		otherDone := make(chan string)
+		go func() {
+			otherDone <- names.lookup(context.Background(), "projects", "project:proj_web", func() (map[string]string, error) {
+				return map[string]string{"project:proj_web": "Web"}, nil
+			})
+		}()
+		select {
+		case name := <-otherDone:
+			if name != "Web" {
+				t.Errorf("unexpected project name %q", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("lookup was blocked by another fetch")
+		}
+
+		close(release)
+		wg.Wait()
+		if fetches.Load() != 1 {
+			t.Errorf("expected a single fetch, got %d", fetches.Load())
+		}
+	})
+}
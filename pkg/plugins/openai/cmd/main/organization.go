@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
+	"github.com/opencost/opencost/core/pkg/log"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"github.com/opencost/opencost/core/pkg/util/timeutil"
+)
+
+const openAIOrganizationURL = "https://api.openai.com/v1/organization"
+
+// usageEndpoints are the organization usage APIs that report token usage
+var usageEndpoints = []string{"completions", "embeddings", "moderations"}
+
+// getOrganizationCostsForWindow returns the costs in window from the
+// organization costs API, with the token usage of each from the usage APIs.
+// The costs API only has daily buckets, so the costs of hourly windows are
+// their share of the day's costs by tokens, and the day's costs are shared by
+// the windows through days.
+func (d *OpenAICostSource) getOrganizationCostsForWindow(ctx context.Context, window opencost.Window, days *dayCache) ([]*pb.CustomCost, error) {
+	if window.Duration() == timeutil.Day {
+		day, err := d.getOrganizationDay(ctx, window)
+		if err != nil {
+			return nil, err
+		}
+		return d.getCustomCostsFromOrganization(ctx, day.costs, day.tokens), nil
+	}
+
+	dayStart := window.Start().UTC().Truncate(timeutil.Day)
+	dayEnd := dayStart.Add(timeutil.Day)
+	day, err := days.get(ctx, dayStart, func() (*organizationDay, error) {
+		return d.getOrganizationDay(ctx, opencost.NewWindow(&dayStart, &dayEnd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	usage, err := d.getOrganizationUsage(ctx, window, "1h")
+	if err != nil {
+		return nil, err
+	}
+	tokens := sumTokens(usage)
+	timeShare := window.Duration().Hours() / timeutil.Day.Hours()
+	return d.getCustomCostsFromOrganization(ctx, apportionCosts(day, tokens, timeShare), tokens), nil
+}
+
+// organizationDay is a day's costs, and the token usage they're for by
+// project and model.
+type organizationDay struct {
+	costs  []openaiplugin.CostsResult
+	tokens map[string]apiKeyTokens
+}
+
+// apiKeyTokens are the tokens of each API key used with a model in a project,
+// keyed by API key ID.
+type apiKeyTokens map[string]openaiplugin.UsageResult
+
+// total returns the tokens of every API key.
+func (t apiKeyTokens) total() openaiplugin.UsageResult {
+	var total openaiplugin.UsageResult
+	for _, usage := range t {
+		total.InputTokens += usage.InputTokens
+		total.OutputTokens += usage.OutputTokens
+		total.InputCachedTokens += usage.InputCachedTokens
+	}
+	return total
+}
+
+// getOrganizationDay returns the costs and token usage in the day long window.
+func (d *OpenAICostSource) getOrganizationDay(ctx context.Context, window opencost.Window) (*organizationDay, error) {
+	costBuckets, err := getOrganizationPages[openaiplugin.CostsResult](ctx, d, "costs", window, "1d", []string{"project_id", "line_item"})
+	if err != nil {
+		return nil, fmt.Errorf("error getting costs: %v", err)
+	}
+	usage, err := d.getOrganizationUsage(ctx, window, "1d")
+	if err != nil {
+		return nil, err
+	}
+
+	var costs []openaiplugin.CostsResult
+	for _, bucket := range costBuckets {
+		costs = append(costs, bucket.Results...)
+	}
+	return &organizationDay{
+		costs:  costs,
+		tokens: sumTokens(usage),
+	}, nil
+}
+
+// getOrganizationUsage returns the token usage in window from every usage
+// endpoint, in buckets of bucketWidth.
+func (d *OpenAICostSource) getOrganizationUsage(ctx context.Context, window opencost.Window, bucketWidth string) ([]openaiplugin.UsageResult, error) {
+	var usage []openaiplugin.UsageResult
+	for _, endpoint := range usageEndpoints {
+		usageBuckets, err := getOrganizationPages[openaiplugin.UsageResult](ctx, d, "usage/"+endpoint, window, bucketWidth, []string{"project_id", "model", "api_key_id"})
+		if err != nil {
+			return nil, fmt.Errorf("error getting %s usage: %v", endpoint, err)
+		}
+		for _, bucket := range usageBuckets {
+			usage = append(usage, bucket.Results...)
+		}
+	}
+	return usage, nil
+}
+
+// apportionCosts returns the share of each of the day's costs that belongs to
+// a window with the given token usage, which is timeShare of the day. Costs
+// are shared by the tokens of their line item, and costs without token usage
+// in the day, like images, by time.
+func apportionCosts(day *organizationDay, tokens map[string]apiKeyTokens, timeShare float64) []openaiplugin.CostsResult {
+	apportioned := make([]openaiplugin.CostsResult, 0, len(day.costs))
+	for _, result := range day.costs {
+		model, kind := splitLineItem(stringValue(result.LineItem))
+		key := orgUsageKey(stringValue(result.ProjectID), model)
+		share := timeShare
+		if dayTokens := lineItemTokens(day.tokens[key].total(), kind); dayTokens > 0 {
+			share = float64(lineItemTokens(tokens[key].total(), kind)) / float64(dayTokens)
+		}
+		if share == 0 {
+			continue
+		}
+		result.Amount.Value *= share
+		apportioned = append(apportioned, result)
+	}
+	return apportioned
+}
+
+// getOrganizationPages returns the buckets of endpoint in window, following
+// the cursor through every page.
+func getOrganizationPages[T any](ctx context.Context, d *OpenAICostSource, endpoint string, window opencost.Window, bucketWidth string, groupBy []string) ([]openaiplugin.OrganizationBucket[T], error) {
+	var buckets []openaiplugin.OrganizationBucket[T]
+	var page *string
+	for {
+		params := url.Values{}
+		params.Set("start_time", strconv.FormatInt(window.Start().Unix(), 10))
+		params.Set("end_time", strconv.FormatInt(window.End().Unix(), 10))
+		params.Set("bucket_width", bucketWidth)
+		for _, group := range groupBy {
+			params.Add("group_by", group)
+		}
+		if page != nil {
+			params.Set("page", *page)
+		}
+		requestURL := d.organizationURL + "/" + endpoint + "?" + params.Encode()
+		log.Debugf("fetching OpenAI organization data from %s", requestURL)
+
+		resp, err := d.doOpenAIRequest(ctx, requestURL, d.config.AdminKey)
+		if err != nil {
+			return nil, fmt.Errorf("error making %s request: %v", endpoint, err)
+		}
+		var result openaiplugin.OrganizationPage[T]
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s response: %v", endpoint, err)
+		}
+
+		buckets = append(buckets, result.Data...)
+		if !result.HasMore || result.NextPage == nil {
+			return buckets, nil
+		}
+		page = result.NextPage
+	}
+}
+
+// sumTokens returns the token usage in usage by project and model, and API
+// key.
+func sumTokens(usage []openaiplugin.UsageResult) map[string]apiKeyTokens {
+	tokens := map[string]apiKeyTokens{}
+	for _, result := range usage {
+		key := orgUsageKey(stringValue(result.ProjectID), stringValue(result.Model))
+		if tokens[key] == nil {
+			tokens[key] = apiKeyTokens{}
+		}
+		apiKeyID := stringValue(result.APIKeyID)
+		total := tokens[key][apiKeyID]
+		total.InputTokens += result.InputTokens
+		total.OutputTokens += result.OutputTokens
+		total.InputCachedTokens += result.InputCachedTokens
+		tokens[key][apiKeyID] = total
+	}
+	return tokens
+}
+
+// lineItemCost is the cost of a line item in a project.
+type lineItemCost struct {
+	projectID string
+	lineItem  string
+	amount    float64
+}
+
+// getCustomCostsFromOrganization converts the costs of each project and line
+// item to custom costs per API key, with the tokens of the line item's model
+// used by the project with the key as their usage. The costs API doesn't
+// report API keys, so costs are split between keys by their share of the
+// line item's tokens. Line items are already split into input, cached input
+// and output tokens, which are priced from the model prices.
+func (d *OpenAICostSource) getCustomCostsFromOrganization(ctx context.Context, costs []openaiplugin.CostsResult, tokens map[string]apiKeyTokens) []*pb.CustomCost {
+	// the same project and line item can be in more than one bucket
+	var lineItems []*lineItemCost
+	byId := map[string]*lineItemCost{}
+	for _, result := range costs {
+		projectID := stringValue(result.ProjectID)
+		lineItem := stringValue(result.LineItem)
+		id := fmt.Sprintf("%s/%s", projectID, lineItem)
+		if _, found := byId[id]; !found {
+			byId[id] = &lineItemCost{projectID: projectID, lineItem: lineItem}
+			lineItems = append(lineItems, byId[id])
+		}
+		byId[id].amount += result.Amount.Value
+	}
+
+	var customCosts []*pb.CustomCost
+	for _, item := range lineItems {
+		model, kind := splitLineItem(item.lineItem)
+		keyTokens := tokens[orgUsageKey(item.projectID, model)]
+		lineItemTotal := lineItemTokens(keyTokens.total(), kind)
+		projectName := d.projectName(ctx, item.projectID)
+		price, hasPrice := d.modelPrices.Lookup(model)
+		unitPrice := price.UnitPrice(tokenKind(kind))
+
+		// line items without tokens, like images, aren't split by API key
+		apiKeyIDs := []string{""}
+		if lineItemTotal > 0 {
+			apiKeyIDs = make([]string, 0, len(keyTokens))
+			for apiKeyID := range keyTokens {
+				apiKeyIDs = append(apiKeyIDs, apiKeyID)
+			}
+			sort.Strings(apiKeyIDs)
+		}
+		for _, apiKeyID := range apiKeyIDs {
+			share := 1.0
+			var quantity int64
+			if lineItemTotal > 0 {
+				quantity = lineItemTokens(keyTokens[apiKeyID], kind)
+				if quantity == 0 {
+					continue
+				}
+				share = float64(quantity) / float64(lineItemTotal)
+			}
+
+			providerId := fmt.Sprintf("%s/%s", item.projectID, item.lineItem)
+			if apiKeyID != "" {
+				providerId += "/" + apiKeyID
+			}
+			extendedAttrs := pb.CustomCostExtendedAttributes{
+				SubAccountId:   &item.projectID,
+				SubAccountName: &projectName,
+			}
+			customCost := &pb.CustomCost{
+				BilledCost:         float32(item.amount * share),
+				ListCost:           float32(item.amount * share),
+				ChargeCategory:     "Usage",
+				Description:        fmt.Sprintf("OpenAI usage for %s", item.lineItem),
+				ResourceName:       model,
+				ResourceType:       "AI Model",
+				Id:                 providerId,
+				ProviderId:         providerId,
+				UsageQuantity:      float32(quantity),
+				UsageUnit:          "tokens",
+				Labels:             costLabels(d.config.ProjectLabels, item.projectID, projectName, apiKeyID, d.apiKeyName(ctx, item.projectID, apiKeyID)),
+				ExtendedAttributes: &extendedAttrs,
+			}
+			// line items without token prices, like images, are billed at list
+			if hasPrice && unitPrice > 0 {
+				listUnitPrice, listCost := listPricing(float64(quantity), unitPrice, item.amount*share)
+				customCost.ListUnitPrice = float32(listUnitPrice)
+				customCost.ListCost = float32(listCost)
+			}
+			customCosts = append(customCosts, customCost)
+		}
+	}
+	return customCosts
+}
+
+// splitLineItem splits a cost line item, e.g. "gpt-4o-2024-08-06, input",
+// into its model and the kind of usage it's for.
+func splitLineItem(lineItem string) (string, string) {
+	model, kind, _ := strings.Cut(lineItem, ", ")
+	return model, kind
+}
+
+// tokenKind returns the kind of tokens a line item's kind of usage is for, or
+// "" if it isn't for tokens.
+func tokenKind(kind string) string {
+	switch {
+	case strings.Contains(kind, "cached"):
+		return openaiplugin.TokenKindCachedInput
+	case strings.Contains(kind, "input"):
+		return openaiplugin.TokenKindInput
+	case strings.Contains(kind, "output"):
+		return openaiplugin.TokenKindOutput
+	default:
+		return ""
+	}
+}
+
+// lineItemTokens returns the tokens in usage of the kind of usage a line
+// item is for. Cached input tokens are counted in the input tokens too.
+func lineItemTokens(usage openaiplugin.UsageResult, kind string) int64 {
+	switch tokenKind(kind) {
+	case openaiplugin.TokenKindCachedInput:
+		return usage.InputCachedTokens
+	case openaiplugin.TokenKindInput:
+		return usage.InputTokens - usage.InputCachedTokens
+	case openaiplugin.TokenKindOutput:
+		return usage.OutputTokens
+	default:
+		return usage.InputTokens + usage.OutputTokens
+	}
+}
+
+// orgUsageKey identifies the usage of a model by a project. Model snapshots
+// are named like the models the line items are for.
+func orgUsageKey(projectID, model string) string {
+	return projectID + "/" + openaiplugin.ModelName(model)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencost/opencost-plugins/common/validation"
+	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
+	"github.com/opencost/opencost/core/pkg/model/pb"
+	"github.com/opencost/opencost/core/pkg/opencost"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newTestCostSource returns a cost source for oaiConfig whose organization
+// API requests are served by handler.
+func newTestCostSource(t *testing.T, oaiConfig openaiplugin.OpenAIConfig, handler http.Handler) *OpenAICostSource {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	oaiCostSrc, err := newOpenAICostSource(&oaiConfig, rate.NewLimiter(rate.Inf, 1))
+	if err != nil {
+		t.Fatalf("error creating cost source: %v", err)
+	}
+	oaiCostSrc.organizationURL = srv.URL + "/v1/organization"
+	return oaiCostSrc
+}
+
+// bucket returns a page with a single bucket of results, and the cursor to
+// the next page if there is one.
+func bucket(start time.Time, results []map[string]any, nextPage string) map[string]any {
+	page := map[string]any{
+		"object": "page",
+		"data": []map[string]any{{
+			"object":     "bucket",
+			"start_time": start.Unix(),
+			"end_time":   start.Add(24 * time.Hour).Unix(),
+			"results":    results,
+		}},
+		"has_more": nextPage != "",
+	}
+	if nextPage != "" {
+		page["next_page"] = nextPage
+	}
+	return page
+}
+
+func TestGetOrganizationCostsForWindow(t *testing.T) {
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	cost := func(lineItem string, value float64) map[string]any {
+		return map[string]any{
+			"object":     "organization.costs.result",
+			"amount":     map[string]any{"value": value, "currency": "usd"},
+			"line_item":  lineItem,
+			"project_id": "proj_web",
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/organization/costs", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Authorization") != "Bearer admin-key" {
+			t.Errorf("expected the admin key, got %q", r.Header.Get("Authorization"))
+		}
+		if query.Get("bucket_width") != "1d" || query.Get("start_time") != "1729036800" || query.Get("end_time") != "1729123200" {
+			t.Errorf("unexpected costs query %v", query)
+		}
+		if groupBy := query["group_by"]; len(groupBy) != 2 || groupBy[0] != "project_id" || groupBy[1] != "line_item" {
+			t.Errorf("unexpected group by %v", groupBy)
+		}
+		// the costs are split across two pages
+		if query.Get("page") == "" {
+			json.NewEncoder(w).Encode(bucket(start, []map[string]any{cost("gpt-4o-2024-08-06, input", 1)}, "page-2"))
+			return
+		}
+		if query.Get("page") != "page-2" {
+			t.Errorf("unexpected page %q", query.Get("page"))
+		}
+		json.NewEncoder(w).Encode(bucket(start, []map[string]any{cost("gpt-4o-2024-08-06, output", 2)}, ""))
+	})
+	mux.HandleFunc("/v1/organization/usage/", func(w http.ResponseWriter, r *http.Request) {
+		var results []map[string]any
+		if r.URL.Path == "/v1/organization/usage/completions" {
+			results = []map[string]any{{
+				"object":              "organization.usage.completions.result",
+				"input_tokens":        1000,
+				"input_cached_tokens": 200,
+				"output_tokens":       300,
+				"project_id":          "proj_web",
+				"model":               "gpt-4o-2024-08-06",
+			}}
+		}
+		json.NewEncoder(w).Encode(bucket(start, results, ""))
+	})
+	oaiCostSrc := newTestCostSource(t, openaiplugin.OpenAIConfig{AdminKey: "admin-key"}, mux)
+
+	resp := oaiCostSrc.getOpenAICostsForWindow(context.Background(), window, nil)
+	if len(resp.Errors) != 0 {
+		t.Fatalf("unexpected errors: %v", resp.Errors)
+	}
+	if resp.Metadata["api"] != "organization" {
+		t.Errorf("expected the organization APIs to be used, got %v", resp.Metadata)
+	}
+
+	costs := map[string]*pb.CustomCost{}
+	for _, cost := range resp.Costs {
+		costs[cost.Id] = cost
+	}
+	expected := map[string]struct {
+		billed float32
+		tokens float32
+	}{
+		// cached input tokens are billed on their own line item
+		"proj_web/gpt-4o-2024-08-06, input":  {1, 800},
+		"proj_web/gpt-4o-2024-08-06, output": {2, 300},
+	}
+	if len(costs) != len(expected) {
+		t.Fatalf("expected %d costs, got %v", len(expected), resp.Costs)
+	}
+	for id, want := range expected {
+		cost := costs[id]
+		if cost == nil {
+			t.Errorf("no cost with id %s in %v", id, resp.Costs)
+			continue
+		}
+		if math.Abs(float64(cost.BilledCost-want.billed)) > 1e-6 || cost.UsageQuantity != want.tokens || cost.ResourceName != "gpt-4o-2024-08-06" {
+			t.Errorf("expected cost %s to be billed %f for %f tokens, got %v", id, want.billed, want.tokens, cost)
+		}
+		// $1 for 800 input tokens is far above the model prices
+		if math.Abs(float64(cost.ListCost)-float64(cost.UsageQuantity*cost.ListUnitPrice)) > 1e-6 || cost.ListCost != cost.BilledCost {
+			t.Errorf("expected cost %s to be listed at its billed cost, got %v", id, cost)
+		}
+		if err := validation.ValidateCost(cost); err != nil {
+			t.Errorf("invalid cost %s: %v", id, err)
+		}
+		if cost.ExtendedAttributes.GetSubAccountId() != "proj_web" {
+			t.Errorf("expected cost %s to belong to the project, got %v", id, cost.ExtendedAttributes)
+		}
+	}
+}
+
+func TestGetOrganizationCostsForWindowError(t *testing.T) {
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/organization/costs", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid admin key"}`, http.StatusUnauthorized)
+	})
+	oaiCostSrc := newTestCostSource(t, openaiplugin.OpenAIConfig{AdminKey: "admin-key"}, mux)
+
+	// without a legacy API key to fall back to, the error is returned
+	resp := oaiCostSrc.getOpenAICostsForWindow(context.Background(), window, nil)
+	if len(resp.Errors) != 1 || len(resp.Costs) != 0 {
+		t.Errorf("expected an error and no costs, got %v", resp)
+	}
+}
+
+func TestNewOpenAICostSourceRequiresKey(t *testing.T) {
+	if _, err := newOpenAICostSource(&openaiplugin.OpenAIConfig{}, rate.NewLimiter(rate.Inf, 1)); err == nil {
+		t.Errorf("expected an error without an admin or API key")
+	}
+}
+
+func TestGetCustomCostsHourly(t *testing.T) {
+	day := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+
+	var costsCalls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/organization/costs", func(w http.ResponseWriter, r *http.Request) {
+		costsCalls.Add(1)
+		cost := func(lineItem string, value float64) map[string]any {
+			return map[string]any{"amount": map[string]any{"value": value, "currency": "usd"}, "line_item": lineItem, "project_id": "proj_web"}
+		}
+		json.NewEncoder(w).Encode(bucket(day, []map[string]any{
+			cost("gpt-4o-2024-08-06, input", 2.4),
+			cost("gpt-4o-2024-08-06, output", 4.8),
+			cost("dall-e-3", 2.4),
+		}, ""))
+	})
+	// 200 input and 40 output tokens an hour in the first half of the day
+	mux.HandleFunc("/v1/organization/usage/", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		startTime, err := strconv.ParseInt(query.Get("start_time"), 10, 64)
+		if err != nil {
+			t.Fatalf("error parsing start time: %v", err)
+		}
+		start := time.Unix(startTime, 0).UTC()
+		var results []map[string]any
+		if r.URL.Path == "/v1/organization/usage/completions" {
+			switch {
+			case query.Get("bucket_width") == "1d":
+				results = []map[string]any{{"input_tokens": 2400, "output_tokens": 480, "project_id": "proj_web", "model": "gpt-4o-2024-08-06"}}
+			case query.Get("bucket_width") == "1h" && start.Hour() < 12:
+				results = []map[string]any{{"input_tokens": 200, "output_tokens": 40, "project_id": "proj_web", "model": "gpt-4o-2024-08-06"}}
+			}
+		}
+		json.NewEncoder(w).Encode(bucket(start, results, ""))
+	})
+	oaiCostSrc := newTestCostSource(t, openaiplugin.OpenAIConfig{AdminKey: "admin-key"}, mux)
+
+	resps := oaiCostSrc.GetCustomCosts(&pb.CustomCostRequest{
+		Start:      timestamppb.New(day),
+		End:        timestamppb.New(day.Add(24 * time.Hour)),
+		Resolution: durationpb.New(time.Hour),
+	})
+	if len(resps) != 24 {
+		t.Fatalf("expected 24 hourly responses, got %d", len(resps))
+	}
+	if costsCalls.Load() != 1 {
+		t.Errorf("expected the day's costs to be fetched once, got %d calls", costsCalls.Load())
+	}
+
+	var total float64
+	for i, resp := range resps {
+		if len(resp.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		if resp.Metadata["apportioned"] != "true" {
+			t.Errorf("expected hourly costs to be flagged as apportioned, got %v", resp.Metadata)
+		}
+		costs := map[string]*pb.CustomCost{}
+		for _, cost := range resp.Costs {
+			costs[cost.Id] = cost
+			total += float64(cost.BilledCost)
+			if err := validation.ValidateCost(cost); err != nil {
+				t.Errorf("invalid cost %s in hour %d: %v", cost.Id, i, err)
+			}
+		}
+		// images have no tokens, so they're shared by time
+		if images := costs["proj_web/dall-e-3"]; images == nil || math.Abs(float64(images.BilledCost)-0.1) > 1e-6 {
+			t.Errorf("expected hour %d to be billed $0.10 of images, got %v", i, resp.Costs)
+		}
+		input := costs["proj_web/gpt-4o-2024-08-06, input"]
+		if i < 12 && (input == nil || math.Abs(float64(input.BilledCost)-0.2) > 1e-6 || input.UsageQuantity != 200) {
+			t.Errorf("expected hour %d to be billed $0.20 for 200 input tokens, got %v", i, input)
+		}
+		if i >= 12 && input != nil {
+			t.Errorf("expected no input costs in hour %d without tokens, got %v", i, input)
+		}
+	}
+	if math.Abs(total-9.6) > 1e-4 {
+		t.Errorf("expected the hourly costs to add up to the day's $9.60, got %f", total)
+	}
+}
+
+func TestGetOrganizationCostsForWindowByAPIKey(t *testing.T) {
+	start := time.Date(2024, 10, 16, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	window := opencost.NewWindow(&start, &end)
+
+	var namesCalls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/organization/costs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(bucket(start, []map[string]any{
+			{"amount": map[string]any{"value": 3, "currency": "usd"}, "line_item": "gpt-4o-2024-08-06, input", "project_id": "proj_web"},
+		}, ""))
+	})
+	mux.HandleFunc("/v1/organization/usage/", func(w http.ResponseWriter, r *http.Request) {
+		if groupBy := r.URL.Query()["group_by"]; len(groupBy) != 3 || groupBy[2] != "api_key_id" {
+			t.Errorf("expected usage to be grouped by API key, got %v", groupBy)
+		}
+		var results []map[string]any
+		if r.URL.Path == "/v1/organization/usage/completions" {
+			results = []map[string]any{
+				{"input_tokens": 100, "project_id": "proj_web", "model": "gpt-4o-2024-08-06", "api_key_id": "key_1"},
+				{"input_tokens": 200, "project_id": "proj_web", "model": "gpt-4o-2024-08-06", "api_key_id": "key_2"},
+			}
+		}
+		json.NewEncoder(w).Encode(bucket(start, results, ""))
+	})
+	mux.HandleFunc("/v1/organization/projects", func(w http.ResponseWriter, r *http.Request) {
+		namesCalls.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   []map[string]any{{"id": "proj_web", "name": "Web"}},
+		})
+	})
+	mux.HandleFunc("/v1/organization/projects/proj_web/api_keys", func(w http.ResponseWriter, r *http.Request) {
+		namesCalls.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   []map[string]any{{"id": "key_1", "name": "web backend"}, {"id": "key_2", "name": "web batch"}},
+		})
+	})
+	oaiCostSrc := newTestCostSource(t, openaiplugin.OpenAIConfig{
+		AdminKey:      "admin-key",
+		ProjectLabels: map[string]map[string]string{"proj_web": {"team": "web"}},
+	}, mux)
+
+	for i := 0; i < 2; i++ {
+		resp := oaiCostSrc.getOpenAICostsForWindow(context.Background(), window, nil)
+		if len(resp.Errors) != 0 {
+			t.Fatalf("unexpected errors: %v", resp.Errors)
+		}
+		costs := map[string]*pb.CustomCost{}
+		for _, cost := range resp.Costs {
+			costs[cost.Id] = cost
+		}
+		expected := map[string]struct {
+			billed float32
+			tokens float32
+			apiKey string
+		}{
+			"proj_web/gpt-4o-2024-08-06, input/key_1": {1, 100, "web backend"},
+			"proj_web/gpt-4o-2024-08-06, input/key_2": {2, 200, "web batch"},
+		}
+		if len(costs) != len(expected) {
+			t.Fatalf("expected a cost per API key, got %v", resp.Costs)
+		}
+		for id, want := range expected {
+			cost := costs[id]
+			if cost == nil {
+				t.Errorf("no cost with id %s in %v", id, resp.Costs)
+				continue
+			}
+			if math.Abs(float64(cost.BilledCost-want.billed)) > 1e-6 || cost.UsageQuantity != want.tokens {
+				t.Errorf("expected cost %s to be billed %f for %f tokens, got %v", id, want.billed, want.tokens, cost)
+			}
+			if err := validation.ValidateCost(cost); err != nil {
+				t.Errorf("invalid cost %s: %v", id, err)
+			}
+			if cost.Labels["project"] != "Web" || cost.Labels["api_key"] != want.apiKey || cost.Labels["team"] != "web" {
+				t.Errorf("expected cost %s to be labelled with its project, API key and team, got %v", id, cost.Labels)
+			}
+		}
+	}
+	// names are kept between windows
+	if namesCalls.Load() != 2 {
+		t.Errorf("expected project and API key names to be fetched once, got %d calls", namesCalls.Load())
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/opencost/opencost-plugins/common/validation"
+	openaiplugin "github.com/opencost/opencost-plugins/pkg/plugins/openai/openaiplugin"
 	"github.com/opencost/opencost/core/pkg/log"
 	"github.com/opencost/opencost/core/pkg/model/pb"
-	"google.golang.org/protobuf/encoding/protojson"
 )
 
 // the validator is designed to allow plugin implementors to validate their plugin information
@@ -36,7 +37,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	dailyCustomCostResponses, err := Unmarshal(data)
+	dailyCustomCostResponses, err := validation.Unmarshal(data)
 	if err != nil {
 		fmt.Printf("Error unmarshalling daily protobuf data: %v\n", err)
 		os.Exit(1)
@@ -54,7 +55,7 @@ func main() {
 	}
 
 	// read in the protobuf file
-	hourlyCustomCostResponses, err := Unmarshal(data)
+	hourlyCustomCostResponses, err := validation.Unmarshal(data)
 	if err != nil {
 		fmt.Printf("Error unmarshalling hourly protobuf data: %v\n", err)
 		os.Exit(1)
@@ -79,10 +80,17 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 
 	var multiErr error
 
-	// parse the response and look for errors
-	for _, resp := range respDaily {
-		if len(resp.Errors) > 0 {
-			multiErr = multierror.Append(multiErr, fmt.Errorf("errors occurred in daily response: %v", resp.Errors))
+	// check the responses against the FOCUS rules shared by all plugins
+	if err := validation.ValidateResponses(respDaily, "openai", 24*time.Hour); err != nil {
+		multiErr = multierror.Append(multiErr, fmt.Errorf("invalid daily response: %v", err))
+	}
+	// hourly responses are only returned when the plugin has an admin key
+	if len(respHourly) > 0 {
+		if err := validation.ValidateResponses(respHourly, "openai", time.Hour); err != nil {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("invalid hourly response: %v", err))
+		}
+		if err := validateHourlySums(respDaily, respHourly); err != nil {
+			multiErr = multierror.Append(multiErr, err)
 		}
 	}
 
@@ -102,7 +110,9 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 
 		for _, cost := range resp.Costs {
 			costSum += cost.GetBilledCost()
-			seenCosts[cost.GetResourceName()] = true
+			// the legacy APIs name models for display and the organization
+			// APIs by snapshot
+			seenCosts[openaiplugin.ModelName(cost.GetResourceName())] = true
 			if cost.GetBilledCost() == 0 {
 				log.Debugf("got zero cost for %v", cost)
 			}
@@ -118,8 +128,8 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 		return false
 	}
 	expectedCosts := []string{
-		"GPT-4o mini",
-		"GPT-4o",
+		"gpt-4o-mini",
+		"gpt-4o",
 	}
 
 	for _, cost := range expectedCosts {
@@ -129,14 +139,6 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 		}
 	}
 
-	// verify the domain matches the plugin name
-	for _, resp := range respDaily {
-		if resp.Domain != "openai" {
-			log.Errorf("daily domain returned by plugin openai does not match plugin name")
-			return false
-		}
-	}
-
 	if len(seenCosts) < len(expectedCosts)-1 || len(seenCosts) > len(expectedCosts)+1 {
 		log.Errorf("daily costs returned by openai plugin are very different than expected")
 		return false
@@ -144,19 +146,38 @@ func validate(respDaily, respHourly []*pb.CustomCostResponse) bool {
 	return true
 }
 
-func Unmarshal(data []byte) ([]*pb.CustomCostResponse, error) {
-	var raw []json.RawMessage
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return nil, err
-	}
-	protoResps := make([]*pb.CustomCostResponse, len(raw))
-	for i, r := range raw {
-		p := &pb.CustomCostResponse{}
-		if err := protojson.Unmarshal(r, p); err != nil {
-			return nil, err
+// validateHourlySums checks that the hourly costs of each day add up to its
+// daily costs, as the hourly costs are the day's costs apportioned by tokens.
+// Days with errors or missing hours are skipped.
+func validateHourlySums(respDaily, respHourly []*pb.CustomCostResponse) error {
+	hourlySums := map[time.Time]float64{}
+	hours := map[time.Time]int{}
+	failed := map[time.Time]bool{}
+	for _, resp := range respHourly {
+		day := resp.Start.AsTime().UTC().Truncate(24 * time.Hour)
+		if len(resp.Errors) > 0 {
+			failed[day] = true
+			continue
+		}
+		hours[day]++
+		for _, cost := range resp.Costs {
+			hourlySums[day] += float64(cost.GetBilledCost())
 		}
-		protoResps[i] = p
 	}
 
-	return protoResps, nil
+	var multiErr error
+	for _, resp := range respDaily {
+		day := resp.Start.AsTime().UTC()
+		if len(resp.Errors) > 0 || failed[day] || hours[day] != 24 {
+			continue
+		}
+		var dailySum float64
+		for _, cost := range resp.Costs {
+			dailySum += float64(cost.GetBilledCost())
+		}
+		if math.Abs(hourlySums[day]-dailySum) > max(0.01, 0.01*dailySum) {
+			multiErr = multierror.Append(multiErr, fmt.Errorf("hourly costs of %s add up to %f, but the daily costs are %f", day.Format(time.DateOnly), hourlySums[day], dailySum))
+		}
+	}
+	return multiErr
 }
@@ -0,0 +1,92 @@
+package openaiplugin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//go:embed modelprices.json
+var defaultModelPrices []byte
+
+// Kinds of tokens each model's usage is billed for.
+const (
+	TokenKindInput       = "input"
+	TokenKindCachedInput = "cached input"
+	TokenKindOutput      = "output"
+)
+
+// TokenKinds are the kinds of tokens in the order their costs are reported.
+var TokenKinds = []string{TokenKindInput, TokenKindCachedInput, TokenKindOutput}
+
+// ModelPrices are OpenAI's public prices, keyed by model without its
+// snapshot date, e.g. "gpt-4o".
+type ModelPrices struct {
+	Version string                `json:"version"`
+	Prices  map[string]ModelPrice `json:"prices"`
+}
+
+// ModelPrice is the price of a million tokens of each kind of a model.
+type ModelPrice struct {
+	Input float64 `json:"input"`
+	// CachedInput is the discounted price of input tokens read from the
+	// prompt cache
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+}
+
+// UnitPrice returns the price of a single token of kind.
+func (p ModelPrice) UnitPrice(kind string) float64 {
+	switch kind {
+	case TokenKindInput:
+		return p.Input / 1e6
+	case TokenKindCachedInput:
+		return p.CachedInput / 1e6
+	case TokenKindOutput:
+		return p.Output / 1e6
+	default:
+		return 0
+	}
+}
+
+var modelSnapshotRe = regexp.MustCompile(`-(\d{4}-\d{2}-\d{2}|\d{4})$`)
+
+// ModelName returns the model that model is a snapshot or display name of.
+// Snapshots are dated, e.g. "gpt-4o-mini-2024-07-18", or for older models
+// short, e.g. "gpt-4-0613", and display names are like "GPT-4o mini", which
+// are "gpt-4o-mini" and "gpt-4".
+func ModelName(model string) string {
+	name := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(model)), " ", "-")
+	return modelSnapshotRe.ReplaceAllString(name, "")
+}
+
+// Lookup returns the price of model, which may be a snapshot or a display
+// name, as per ModelName.
+func (p *ModelPrices) Lookup(model string) (ModelPrice, bool) {
+	price, ok := p.Prices[ModelName(model)]
+	return price, ok
+}
+
+// LoadModelPrices returns the model prices embedded in the plugin with the
+// models in overrides replacing or adding to its prices.
+func LoadModelPrices(overrides ModelPrices) (*ModelPrices, error) {
+	var prices ModelPrices
+	if err := json.Unmarshal(defaultModelPrices, &prices); err != nil {
+		return nil, fmt.Errorf("error parsing embedded model prices: %v", err)
+	}
+	if len(overrides.Prices) == 0 {
+		return &prices, nil
+	}
+
+	overridesVersion := overrides.Version
+	if overridesVersion == "" {
+		overridesVersion = "custom"
+	}
+	prices.Version += "+" + overridesVersion
+	for model, price := range overrides.Prices {
+		prices.Prices[model] = price
+	}
+	return &prices, nil
+}
@@ -0,0 +1,69 @@
+package openaiplugin
+
+import (
+	"math"
+	"testing"
+)
+
+func TestModelName(t *testing.T) {
+	tests := map[string]string{
+		"gpt-4o-mini-2024-07-18": "gpt-4o-mini",
+		"gpt-4-0613":             "gpt-4",
+		"gpt-3.5-turbo-0125":     "gpt-3.5-turbo",
+		" GPT-4o mini ":          "gpt-4o-mini",
+		"o1":                     "o1",
+		"gpt-4-32k":              "gpt-4-32k",
+	}
+	for model, expected := range tests {
+		if name := ModelName(model); name != expected {
+			t.Errorf("expected %q to be model %q, got %q", model, expected, name)
+		}
+	}
+}
+
+func TestLoadModelPrices(t *testing.T) {
+	prices, err := LoadModelPrices(ModelPrices{})
+	if err != nil {
+		t.Fatalf("error loading embedded model prices: %v", err)
+	}
+	if prices.Version == "" {
+		t.Errorf("embedded model prices have no version")
+	}
+
+	tests := []struct {
+		model     string
+		kind      string
+		unitPrice float64
+	}{
+		{model: "gpt-4o-2024-08-06", kind: TokenKindInput, unitPrice: 2.5e-6},
+		{model: "gpt-4o-2024-08-06", kind: TokenKindCachedInput, unitPrice: 1.25e-6},
+		{model: "GPT-4o mini", kind: TokenKindOutput, unitPrice: 0.6e-6},
+		{model: "gpt-3.5-turbo-0125", kind: TokenKindInput, unitPrice: 0.5e-6},
+	}
+	for _, tt := range tests {
+		price, ok := prices.Lookup(tt.model)
+		if !ok {
+			t.Errorf("no price for %s", tt.model)
+			continue
+		}
+		if unitPrice := price.UnitPrice(tt.kind); math.Abs(unitPrice-tt.unitPrice) > 1e-12 {
+			t.Errorf("expected %s %s tokens to cost %g, got %g", tt.model, tt.kind, tt.unitPrice, unitPrice)
+		}
+	}
+	if _, ok := prices.Lookup("dall-e-3"); ok {
+		t.Errorf("expected no token price for dall-e-3")
+	}
+
+	overridden, err := LoadModelPrices(ModelPrices{
+		Prices: map[string]ModelPrice{"gpt-4o": {Input: 2, Output: 8}},
+	})
+	if err != nil {
+		t.Fatalf("error loading overridden model prices: %v", err)
+	}
+	if overridden.Version != prices.Version+"+custom" {
+		t.Errorf("unexpected overridden version %q", overridden.Version)
+	}
+	if price, _ := overridden.Lookup("gpt-4o"); price.Input != 2 {
+		t.Errorf("expected override to replace the gpt-4o price, got %v", price)
+	}
+}
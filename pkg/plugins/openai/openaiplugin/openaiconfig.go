@@ -1,6 +1,24 @@
 package openaiplugin
 
+import "github.com/opencost/opencost-plugins/common/sdk"
+
 type OpenAIConfig struct {
+	// AdminKey is an admin key of the organization, which costs are fetched
+	// from the organization usage and costs APIs with
+	AdminKey string `json:"openai_admin_key"`
+	// APIKey is a key for the legacy usage and billing export APIs, which are
+	// used when there is no admin key, or the organization APIs fail
 	APIKey   string `json:"openai_api_key"`
-	LogLevel string `json:"log_level"`
+	LogLevel string `json:"log_level" default:"info"`
+	// ModelPrices adds to or replaces the public model prices built into the
+	// plugin, which list prices and the split of legacy billing costs into
+	// input, cached input and output tokens are computed from.
+	ModelPrices ModelPrices `json:"model_prices"`
+	// ProjectLabels maps OpenAI projects, by ID or name, to labels added to
+	// their costs, e.g. {"proj_abc": {"namespace": "search", "team": "search"}}
+	// to attribute a project's costs to a Kubernetes namespace or team.
+	ProjectLabels map[string]map[string]string `json:"project_labels"`
+	// Config holds the caching, timeout, parallelism, metrics and tracing
+	// settings. Windows are only cached 24 hours after they end by default.
+	sdk.Config
 }
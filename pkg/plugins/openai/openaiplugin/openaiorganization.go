@@ -0,0 +1,71 @@
+package openaiplugin
+
+// OrganizationPage is a page of time buckets from the organization usage and
+// costs APIs, e.g. /v1/organization/costs.
+type OrganizationPage[T any] struct {
+	Object   string                  `json:"object"`
+	Data     []OrganizationBucket[T] `json:"data"`
+	HasMore  bool                    `json:"has_more"`
+	NextPage *string                 `json:"next_page"`
+}
+
+// OrganizationBucket holds the results of a bucket_width long time bucket.
+type OrganizationBucket[T any] struct {
+	Object    string `json:"object"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+	Results   []T    `json:"results"`
+}
+
+// CostsResult is the cost of a project and line item in a bucket. Fields the
+// results aren't grouped by are nil.
+type CostsResult struct {
+	Object   string     `json:"object"`
+	Amount   CostAmount `json:"amount"`
+	LineItem *string    `json:"line_item"`
+	// ProjectID is nil for costs that don't belong to a project
+	ProjectID *string `json:"project_id"`
+}
+
+type CostAmount struct {
+	Value    float64 `json:"value"`
+	Currency string  `json:"currency"`
+}
+
+// UsageResult is the token usage of a project, model and API key in a
+// bucket, as reported by the completions, embeddings and moderations usage
+// APIs. Fields the results aren't grouped by are nil.
+type UsageResult struct {
+	Object            string  `json:"object"`
+	InputTokens       int64   `json:"input_tokens"`
+	OutputTokens      int64   `json:"output_tokens"`
+	InputCachedTokens int64   `json:"input_cached_tokens"`
+	NumModelRequests  int64   `json:"num_model_requests"`
+	ProjectID         *string `json:"project_id"`
+	Model             *string `json:"model"`
+	APIKeyID          *string `json:"api_key_id"`
+}
+
+// OrganizationList is a page of objects from the organization administration
+// APIs, e.g. /v1/organization/projects.
+type OrganizationList[T any] struct {
+	Object  string  `json:"object"`
+	Data    []T     `json:"data"`
+	FirstID *string `json:"first_id"`
+	LastID  *string `json:"last_id"`
+	HasMore bool    `json:"has_more"`
+}
+
+type Project struct {
+	Object string `json:"object"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+type ProjectAPIKey struct {
+	Object        string `json:"object"`
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	RedactedValue string `json:"redacted_value"`
+}